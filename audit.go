@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+const auditBucketName = "audit"
+
+// Defaults of the audit retention.
+const (
+	defaultAuditEntries = 100
+	defaultAuditMaxAge  = 30 * 24 * time.Hour
+)
+
+// auditPruneInterval is the interval in which entries of all events are pruned.
+const auditPruneInterval = time.Hour
+
+type auditConfig struct {
+	// Disable recording of decisions.
+	Disable bool `json:",omitempty"`
+	// Entries is the number of entries kept per event, 100 if 0.
+	Entries int `json:",omitempty"`
+	// MaxAge of entries, like "720h". 30 days if empty.
+	MaxAge string `json:",omitempty"`
+	maxAge time.Duration
+}
+
+// auditEntry is a decision made for an event.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	State    string    `json:"state"`
+	OldState string    `json:"oldState,omitempty"`
+	Owned    bool      `json:"owned"`
+	// Mapping is the source of the matched mapping, like "mappings.csv line 12".
+	Mapping  string `json:"mapping,omitempty"`
+	Action   string `json:"action,omitempty"`
+	TicketID int    `json:"ticketId"`
+	Error    string `json:"error,omitempty"`
+}
+
+// audit records the decisions of the ticket updater.
+type audit struct {
+	entries int
+	maxAge  time.Duration
+	now     func() time.Time
+}
+
+func newAudit(c auditConfig) *audit {
+	entries := c.Entries
+	if entries <= 0 {
+		entries = defaultAuditEntries
+	}
+
+	maxAge := c.maxAge
+	if maxAge <= 0 {
+		maxAge = defaultAuditMaxAge
+	}
+
+	return &audit{entries: entries, maxAge: maxAge, now: time.Now}
+}
+
+// auditStart begins recording the decision for the event.
+func (t *ticketUpdater) auditStart(e *event.Notification) {
+	t.decision = &auditEntry{Time: t.audit.now().UTC(), State: stateString(e), TicketID: -1}
+}
+
+// auditFacts records the old state and owned flag the decision is based on.
+func (t *ticketUpdater) auditFacts(old *event.Notification, owned bool) {
+	if t.decision == nil {
+		return
+	}
+
+	if old != nil {
+		t.decision.OldState = stateString(old)
+	}
+
+	t.decision.Owned = owned
+}
+
+// auditAction records the matched mapping, if any, and the action taken.
+func (t *ticketUpdater) auditAction(mapping string, action string) {
+	if t.decision == nil {
+		return
+	}
+
+	t.decision.Mapping = mapping
+	t.decision.Action = action
+}
+
+// auditFinish saves the decision for the event with the resulting ticket and the error of the update. group is the
+// group key of the event if grouping is enabled.
+func (t *ticketUpdater) auditFinish(e *event.Notification, group string, updateErr error) {
+	a := t.decision
+	t.decision = nil
+
+	if updateErr != nil {
+		a.Error = updateErr.Error()
+	}
+
+	// group events are saved by the key of their group.
+	x := e
+	if t.grouping != "" {
+		x = newGroupEvent(group)
+	}
+
+	entry, err := t.cache.getEntry(x)
+	if err != nil {
+		log.Printf("%x ticket updater: couldn't get ticket of audit entry: %v", eventID(e), err)
+	}
+
+	if entry != nil {
+		a.TicketID = entry.TicketID
+	}
+
+	if err := t.cache.putAudit(e, a, t.audit.entries, a.Time.Add(-t.audit.maxAge)); err != nil {
+		log.Printf("%x ticket updater: couldn't save audit entry: %v", eventID(e), err)
+	}
+}
+
+// runAuditPrune removes expired audit entries of all events in the prune interval, it doesn't return.
+func (t *ticketUpdater) runAuditPrune() {
+	for range time.Tick(auditPruneInterval) {
+		n, err := t.cache.pruneAudit(t.audit.now().Add(-t.audit.maxAge))
+		if err != nil {
+			log.Printf("ticket updater: pruning audit entries failed: %v", err)
+			continue
+		}
+
+		if *debug {
+			log.Printf("ticket updater: pruned %v audit entries", n)
+		}
+	}
+}
+
+// auditPrefix is the prefix of the keys of the audit entries of the event key.
+func auditPrefix(key []byte) []byte {
+	return append(append([]byte{}, key...), 0)
+}
+
+// auditKey is the key of an audit entry of the event key, the sequence number keeps them in time order.
+func auditKey(key []byte, seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return append(auditPrefix(key), k...)
+}
+
+// putAudit appends the entry to the audit entries of the event, keeping at most max entries not older than expire.
+func (c *cache) putAudit(e *event.Notification, a *auditEntry, max int, expire time.Time) error {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	return c.Store.Update(func(tx StoreTx) error {
+		seq, err := tx.NextSequence(auditBucketName)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Put(auditBucketName, auditKey(c.key(e), seq), x); err != nil {
+			return err
+		}
+
+		_, err = pruneAuditEntries(tx, auditPrefix(c.key(e)), max, expire)
+		return err
+	})
+}
+
+// getAudit returns the audit entries of the event in time order.
+func (c *cache) getAudit(e *event.Notification) ([]*auditEntry, error) {
+	as := []*auditEntry{}
+
+	err := c.Store.View(func(tx StoreTx) error {
+		return tx.ForEach(auditBucketName, auditPrefix(c.key(e)), func(k, v []byte) error {
+			var a auditEntry
+			if err := json.Unmarshal(v, &a); err != nil {
+				return fmt.Errorf("couldn't decode audit entry %x: %v", k, err)
+			}
+
+			as = append(as, &a)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return as, nil
+}
+
+// pruneAudit removes audit entries older than expire of all events, returning the number of removed entries.
+func (c *cache) pruneAudit(expire time.Time) (int, error) {
+	n := 0
+
+	err := c.Store.Update(func(tx StoreTx) error {
+		var err error
+		n, err = pruneAuditEntries(tx, nil, 0, expire)
+		return err
+	})
+
+	return n, err
+}
+
+// pruneAuditEntries removes the entries with keys starting with prefix older than expire and the oldest entries
+// exceeding max, unless max is 0. It returns the number of removed entries.
+func pruneAuditEntries(tx StoreTx, prefix []byte, max int, expire time.Time) (int, error) {
+	expired := [][]byte{}
+	kept := [][]byte{}
+
+	err := tx.ForEach(auditBucketName, prefix, func(k, v []byte) error {
+		var a auditEntry
+		if err := json.Unmarshal(v, &a); err != nil {
+			return fmt.Errorf("couldn't decode audit entry %x: %v", k, err)
+		}
+
+		// copy the keys, they are only valid during the transaction.
+		if a.Time.Before(expire) {
+			expired = append(expired, append([]byte{}, k...))
+		} else {
+			kept = append(kept, append([]byte{}, k...))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// the oldest entries come first.
+	if max > 0 && len(kept) > max {
+		expired = append(expired, kept[:len(kept)-max]...)
+	}
+
+	for _, k := range expired {
+		if err := tx.Delete(auditBucketName, k); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+// auditCommand runs the audit subcommand with its arguments:
+//
+//	show <host> [service]
+func auditCommand(c *cache, args []string, w io.Writer) error {
+	if len(args) < 2 || len(args) > 3 || args[0] != "show" {
+		return fmt.Errorf("usage: audit show <host> [service]")
+	}
+
+	e := &event.Notification{Host: args[1]}
+	if len(args) == 3 {
+		e.Service = args[2]
+	}
+
+	as, err := c.getAudit(e)
+	if err != nil {
+		return err
+	}
+
+	if len(as) == 0 {
+		return fmt.Errorf("no audit entries for %s", c.key(e))
+	}
+
+	return writeAudit(w, as)
+}
+
+// writeAudit writes the audit entries as a table.
+func writeAudit(w io.Writer, as []*auditEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "TIME\tSTATE\tOLD STATE\tOWNED\tMAPPING\tACTION\tTICKET\tERROR")
+	for _, a := range as {
+		ticket := "-"
+		if a.TicketID != -1 {
+			ticket = fmt.Sprintf("#%v", a.TicketID)
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", a.Time.Local().Format(time.RFC3339), a.State,
+			orDash(a.OldState), a.Owned, orDash(a.Mapping), orDash(a.Action), ticket, orDash(a.Error))
+	}
+
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
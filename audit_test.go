@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func TestTicketUpdaterAudit(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	tu := newTicketUpdater(cache, rt, withSource(testMappings, "mappings.csv"), "", "Test-Queue", []string{"deleted"})
+	tu.audit = newAudit(auditConfig{})
+
+	e := newTestEvent("example.com", "example", event.StateCritical)
+	for _, v := range []event.State{event.StateCritical, event.StateWarning} {
+		e = newTestEvent("example.com", "example", v)
+		if err := tu.update(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rt.failUpdates = true
+	if err := tu.update(newTestEvent("example.com", "example", event.StateOK)); err == nil {
+		t.Fatal("expected error")
+	}
+
+	as, err := cache.getAudit(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(as) != 3 {
+		t.Fatalf("expected 3 entries, got %v", len(as))
+	}
+
+	if as[0].State != "CRITICAL" || as[0].OldState != "" || as[0].Action != "create" || as[0].TicketID != 0 ||
+		!strings.HasPrefix(as[0].Mapping, "mappings.csv line ") {
+		t.Errorf("unexpected first entry: %+v", as[0])
+	}
+
+	if as[1].State != "WARNING" || as[1].OldState != "CRITICAL" || as[1].Action != "comment" || as[1].Owned {
+		t.Errorf("unexpected second entry: %+v", as[1])
+	}
+
+	if as[2].State != "OK" || as[2].Action != "delete" || as[2].Error == "" {
+		t.Errorf("unexpected third entry: %+v", as[2])
+	}
+
+	var buf bytes.Buffer
+	if err := auditCommand(cache, []string{"show", "example.com", "example"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 4 || !strings.Contains(lines[1], "create") {
+		t.Errorf("unexpected output:\n%v", buf.String())
+	}
+
+	if err := auditCommand(cache, []string{"show", "example.com"}, &buf); err == nil {
+		t.Error("expected error for host without entries")
+	}
+
+	if err := auditCommand(cache, []string{"list"}, &buf); err == nil {
+		t.Error("expected usage error")
+	}
+}
+
+func TestAuditRetention(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	now := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	other := &event.Notification{Host: "example.com"}
+
+	for i := 0; i < 5; i++ {
+		a := &auditEntry{Time: now.Add(time.Duration(i) * time.Hour), Action: "comment", TicketID: i}
+		if err := cache.putAudit(testEvent, a, 3, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cache.putAudit(other, &auditEntry{Time: now, Action: "create"}, 3, now); err != nil {
+		t.Fatal(err)
+	}
+
+	as, err := cache.getAudit(testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(as) != 3 || as[0].TicketID != 2 || as[2].TicketID != 4 {
+		t.Errorf("oldest entries weren't removed: %+v", as)
+	}
+
+	n, err := cache.pruneAudit(now.Add(3*time.Hour + time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Errorf("expected 3 pruned entries, got %v", n)
+	}
+
+	as, err = cache.getAudit(testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(as) != 1 || as[0].TicketID != 4 {
+		t.Errorf("expired entries weren't removed: %+v", as)
+	}
+
+	as, err = cache.getAudit(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(as) != 0 {
+		t.Errorf("expired entries weren't removed: %+v", as)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultBackupKeep is the number of snapshots kept if Cache.Backup.Keep isn't set.
+const defaultBackupKeep = 7
+
+// backupPrefix is the prefix of the names of snapshots, followed by the time and the extension of the backend.
+const backupPrefix = "icinga2rt-"
+
+type backupConfig struct {
+	// Dir is the directory snapshots are written to on SIGUSR1 and by the backup command. Disabled if empty.
+	Dir string `json:",omitempty"`
+	// Keep is the number of snapshots kept in Dir, the oldest are removed. defaultBackupKeep if 0.
+	Keep int `json:",omitempty"`
+}
+
+// backupExt returns the extension of snapshots of the backend.
+func backupExt(backend string) string {
+	switch backend {
+	case backendJSON, backendMemory:
+		return ".json"
+	default:
+		return ".bolt"
+	}
+}
+
+// backup writes a snapshot of the cache to dir, named by the time, and removes the oldest snapshots so keep are
+// left. It returns the path of the snapshot and its size. The daemon keeps running while it's written.
+func (c *cache) backup(dir string, keep int, backend string, now time.Time) (string, int64, error) {
+	if keep <= 0 {
+		keep = defaultBackupKeep
+	}
+
+	ext := backupExt(backend)
+	path := filepath.Join(dir, backupPrefix+now.UTC().Format("20060102T150405.000Z")+ext)
+
+	// the snapshot only gets its name when it's complete, incomplete snapshots are never rotated or restored.
+	f, err := os.CreateTemp(dir, "."+backupPrefix)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n, err := c.Store.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+
+	return path, n, rotateBackups(dir, ext, keep)
+}
+
+// rotateBackups removes the oldest snapshots with the extension in dir, so keep are left.
+func rotateBackups(dir string, ext string, keep int) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, v := range files {
+		if !v.IsDir() && strings.HasPrefix(v.Name(), backupPrefix) && strings.HasSuffix(v.Name(), ext) {
+			names = append(names, v.Name())
+		}
+	}
+
+	// the names sort by time.
+	sort.Strings(names)
+
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+
+		names = names[1:]
+	}
+
+	return nil
+}
+
+// runBackup writes a snapshot of the cache like configured in conf on every SIGUSR1.
+func (c *cache) runBackup(conf cacheConfig) {
+	// without signals, Notify would relay all signals.
+	if len(backupSignals) == 0 {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, backupSignals...)
+
+	for range signals {
+		path, n, err := c.backup(conf.Backup.Dir, conf.Backup.Keep, conf.Backend, time.Now())
+		if err != nil {
+			log.Printf("cache: backup failed: %v", err)
+			continue
+		}
+
+		log.Printf("cache: wrote backup %v, %v bytes", path, n)
+	}
+}
+
+// checkSnapshot returns an error if the snapshot at path can't be restored to a cache of the backend.
+func checkSnapshot(backend string, path string) error {
+	s, err := openSnapshot(backend, path)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	defer s.Close()
+
+	var version string
+	err = s.View(func(tx StoreTx) error {
+		version = string(tx.Get(metaBucketName, []byte(metaSchemaVersion)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch version {
+	case cacheSchemaVersion, "2":
+		// older versions are migrated when the cache is opened.
+		return nil
+	case "":
+		return fmt.Errorf("%v has no schema version, it isn't a snapshot of a cache", path)
+	default:
+		return fmt.Errorf("%v has schema version %v, which this version of icinga2rt doesn't know", path, version)
+	}
+}
+
+// restore replaces the file of the cache with the snapshot at path, after checking its schema version. The cache
+// is closed, as its file is replaced.
+func (c *cache) restore(conf cacheConfig, path string) error {
+	if conf.Backend == backendMemory {
+		return fmt.Errorf("the memory backend can't be restored")
+	}
+
+	if err := checkSnapshot(conf.Backend, path); err != nil {
+		return err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// copy next to the cache first, so the cache is only replaced by a complete copy.
+	f, err := os.CreateTemp(filepath.Dir(conf.File), "."+filepath.Base(conf.File))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, src)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = c.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), conf.File)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
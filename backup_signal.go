@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// backupSignals trigger a backup of the cache.
+var backupSignals = []os.Signal{syscall.SIGUSR1}
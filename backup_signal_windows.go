@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// backupSignals trigger a backup of the cache. Windows has no SIGUSR1, the backup command has to be used.
+var backupSignals = []os.Signal{}
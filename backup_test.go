@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func TestCacheBackup(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cache is reopened after the restore.
+	defer func() { removeCache(cache, cachePath) }()
+
+	dir, err := os.MkdirTemp("", "icinga2rt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	putTestEntries(t, cache, map[string]int{"example.com/http": 1})
+
+	now := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+
+	paths := []string{}
+	for i := 0; i < 3; i++ {
+		path, n, err := cache.backup(dir, 2, backendBolt, now.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi, err := os.Stat(path); err != nil || fi.Size() != n {
+			t.Errorf("expected snapshot of %v bytes: %v %v", n, fi, err)
+		}
+
+		paths = append(paths, path)
+
+		// changed after the first snapshot.
+		putTestEntries(t, cache, map[string]int{"example.com/ssh": 2})
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 || files[0].Name() != filepath.Base(paths[1]) {
+		t.Errorf("expected the last 2 snapshots, got %v", files)
+	}
+
+	if err := cache.restore(cacheConfig{File: cachePath}, filepath.Join(dir, "missing.bolt")); err == nil {
+		t.Error("expected error for missing snapshot")
+	}
+
+	// changed after the last snapshot, which is restored.
+	if err := cache.deleteEventTicket(&event.Notification{Host: "example.com", Service: "http"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.restore(cacheConfig{File: cachePath}, paths[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = openCache(cachePath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ets, err := cache.allEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ets) != 2 {
+		t.Errorf("expected 2 restored entries, got %v", len(ets))
+	}
+}
+
+func TestCheckSnapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "icinga2rt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newMemoryStore()
+	cache, err := newCache(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, _, err := cache.backup(dir, 0, backendMemory, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkSnapshot(backendJSON, path); err != nil {
+		t.Errorf("expected snapshot of the memory backend to be restorable to json: %v", err)
+	}
+
+	err = store.Update(func(tx StoreTx) error {
+		return tx.Put(metaBucketName, []byte(metaSchemaVersion), []byte("99"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, _, err = cache.backup(dir, 0, backendMemory, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkSnapshot(backendJSON, path); err == nil {
+		t.Error("expected error for unknown schema version")
+	}
+
+	empty := filepath.Join(dir, "empty.json")
+	if err := os.WriteFile(empty, []byte(`{"buckets":{}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkSnapshot(backendJSON, empty); err == nil {
+		t.Error("expected error for snapshot without schema version")
+	}
+}
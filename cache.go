@@ -3,19 +3,34 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/json"
+	"fmt"
 	"hash/fnv"
-	"io"
 	"log"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/bytemine/go-icinga2/event"
-	bolt "github.com/etcd-io/bbolt" // bbolt is the continuation of bolt and for now is usable as drop in replacement
 )
 
 const eventBucketName = "events"
 const pendingBucketName = "pendingEvents"
+const metaBucketName = "meta"
 
-// eventID generates an internal id to prevent using nested maps
+// Keys of the meta bucket.
+const (
+	metaSchemaVersion = "schemaVersion"
+	metaNamespace     = "namespace"
+)
+
+// cacheLockTimeout is the time to wait for the lock of the cache file, which is held while icinga2rt is running.
+const cacheLockTimeout = 5 * time.Second
+
+// cacheSchemaVersion is the version of the keys and values of the cache. Caches without version use the hashed keys
+// of eventID, caches of version 2 store gob encoded values.
+const cacheSchemaVersion = "3"
+
+// eventID generates a short id of the event used in log messages. It isn't unique, use cache.key for keys.
 func eventID(e *event.Notification) []byte {
 	h := fnv.New64a()
 
@@ -27,26 +42,234 @@ func eventID(e *event.Notification) []byte {
 }
 
 type cache struct {
-	*bolt.DB
+	Store
 	debug bool
+	// namespace of the keys, optional.
+	namespace string
+}
+
+// openCache opens the bolt cache at path, see newCache.
+func openCache(path string, namespace string) (*cache, error) {
+	store, err := openBoltStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCache(store, namespace)
 }
 
-func openCache(path string) (*cache, error) {
-	db, err := bolt.Open(path, 0600, nil)
+// newCache returns the cache in store, migrating the keys of its entries if they were saved by an older version or
+// with another namespace. The store is closed if it fails.
+func newCache(store Store, namespace string) (*cache, error) {
+	c := &cache{Store: store, namespace: namespace}
+
+	if err := c.migrate(); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	rebuilt, err := c.checkTicketIndex()
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
 
-	return &cache{DB: db}, nil
+	if rebuilt {
+		log.Printf("cache: rebuilt ticket index")
+	}
+
+	return c, nil
+}
+
+// key returns the key of the event in the cache, like "service/example.com/http", "host/example.com" or "group/web"
+// for groups, prefixed with the namespace if set. The parts are escaped, so different events always have different
+// keys.
+func (c *cache) key(e *event.Notification) []byte {
+	parts := []string{}
+
+	if c.namespace != "" {
+		parts = append(parts, url.PathEscape(c.namespace))
+	}
+
+	typ := objectType(e)
+	// groups may be named like hosts.
+	if isGroupEvent(e) {
+		typ = "group"
+	}
+
+	parts = append(parts, typ, url.PathEscape(e.Host))
+
+	if e.Service != "" {
+		parts = append(parts, url.PathEscape(e.Service))
+	}
+
+	return []byte(strings.Join(parts, "/"))
+}
+
+// migrate re-keys the entries of the events and pending events buckets and the audit entries, if the schema version
+// or namespace of the cache differ, and records them in the meta bucket.
+func (c *cache) migrate() error {
+	return c.Store.Update(func(tx StoreTx) error {
+		version := string(tx.Get(metaBucketName, []byte(metaSchemaVersion)))
+		namespace := string(tx.Get(metaBucketName, []byte(metaNamespace)))
+
+		if version == cacheSchemaVersion && namespace == c.namespace {
+			return nil
+		}
+
+		switch version {
+		case "", "2", cacheSchemaVersion:
+		default:
+			return fmt.Errorf("unknown cache schema version %v", version)
+		}
+
+		n, err := c.rekey(tx, eventBucketName, func(x []byte) (*event.Notification, []byte, error) {
+			et, err := decodeEventTicket(x)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			y, err := encodeEventTicket(et)
+			return et.Event, y, err
+		})
+		if err != nil {
+			return err
+		}
+
+		m, err := c.rekey(tx, pendingBucketName, func(x []byte) (*event.Notification, []byte, error) {
+			p, err := decodePendingEvent(x)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			y, err := encodePendingEvent(p)
+			return p.Event, y, err
+		})
+		if err != nil {
+			return err
+		}
+
+		if n+m > 0 {
+			log.Printf("cache: migrated %v entries to schema version %v", n+m, cacheSchemaVersion)
+		}
+
+		if err := c.rekeyAudit(tx, namespace); err != nil {
+			return err
+		}
+
+		if err := tx.Put(metaBucketName, []byte(metaSchemaVersion), []byte(cacheSchemaVersion)); err != nil {
+			return err
+		}
+
+		return tx.Put(metaBucketName, []byte(metaNamespace), []byte(c.namespace))
+	})
+}
+
+// rekey replaces all entries of the bucket with entries recoded by recode under the keys of their events, returning
+// the number of entries. Entries which can't be recoded are moved to the quarantine bucket, so a single bad entry
+// doesn't keep the cache from being opened.
+func (c *cache) rekey(tx StoreTx, name string, recode func([]byte) (*event.Notification, []byte, error)) (int, error) {
+	entries := map[string][]byte{}
+	bad := map[string][]byte{}
+
+	err := tx.ForEach(name, nil, func(k, v []byte) error {
+		e, x, err := recode(v)
+		if err != nil {
+			log.Printf("cache: couldn't migrate entry %x of %v, moved to %v: %v", k, name, quarantineBucketName, err)
+			bad[string(k)] = append([]byte{}, v...)
+			return nil
+		}
+
+		entries[string(c.key(e))] = x
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.DeleteBucket(name); err != nil {
+		return 0, err
+	}
+
+	for k, v := range bad {
+		if err := tx.Put(quarantineBucketName, quarantineKey(name, []byte(k)), v); err != nil {
+			return 0, err
+		}
+	}
+
+	for k, v := range entries {
+		if err := tx.Put(name, []byte(k), v); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(entries), nil
+}
+
+// rekeyAudit moves the audit entries saved with the namespace from to the namespace of the cache. Their keys are
+// changed in place, so the sequence of the bucket is kept.
+func (c *cache) rekeyAudit(tx StoreTx, from string) error {
+	if from == c.namespace {
+		return nil
+	}
+
+	oldPrefix, newPrefix := []byte{}, []byte{}
+	if from != "" {
+		oldPrefix = []byte(url.PathEscape(from) + "/")
+	}
+	if c.namespace != "" {
+		newPrefix = []byte(url.PathEscape(c.namespace) + "/")
+	}
+
+	entries := map[string][]byte{}
+	err := tx.ForEach(auditBucketName, oldPrefix, func(k, v []byte) error {
+		entries[string(k)] = append([]byte{}, v...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, v := range entries {
+		if err := tx.Delete(auditBucketName, []byte(k)); err != nil {
+			return err
+		}
+
+		key := append(append([]byte{}, newPrefix...), k[len(oldPrefix):]...)
+		if err := tx.Put(auditBucketName, key, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// eventTicket is a helper struct for saving to bolt
+// eventTicket is a helper struct for saving to the cache
 type eventTicket struct {
 	Event    *event.Notification
 	TicketID int
+	// Folded is set if the event is tracked on the ticket of its host instead of an own ticket.
+	Folded bool
+	// Members are the failing members and their state if the entry is for a group of events.
+	Members map[string]event.State
+	// Resolved is the time the ticket was resolved by the resolve action.
+	Resolved time.Time
+	// Created is the time the ticket was first saved, zero for entries saved by older versions.
+	Created time.Time
+	// Escalated are the indices of the escalation steps applied to the ticket.
+	Escalated []int
+	// TicketStatus is the status of the ticket when it was last seen.
+	TicketStatus string
+	// History are the last actions applied to the ticket.
+	History []historyEntry
 }
 
+// decodeEventTicket decodes a JSON record, or a gob encoded entry saved by an older version.
 func decodeEventTicket(x []byte) (*eventTicket, error) {
+	if isRecord(x) {
+		return unmarshalTicketRecord(x)
+	}
+
 	var et eventTicket
 	buf := bytes.NewBuffer(x)
 	d := gob.NewDecoder(buf)
@@ -59,33 +282,35 @@ func decodeEventTicket(x []byte) (*eventTicket, error) {
 }
 
 func encodeEventTicket(et *eventTicket) ([]byte, error) {
-	var x bytes.Buffer
+	return marshalTicketRecord(et)
+}
 
-	e := gob.NewEncoder(&x)
-	err := e.Encode(et)
+func (c *cache) getEventTicket(e *event.Notification) (*event.Notification, int, error) {
+	et, err := c.getEntry(e)
 	if err != nil {
-		return nil, err
+		return nil, -1, err
+	}
+
+	if et == nil {
+		return nil, -1, nil
 	}
 
-	return x.Bytes(), nil
+	return et.Event, et.TicketID, nil
 }
 
-func (c *cache) getEventTicket(e *event.Notification) (*event.Notification, int, error) {
+// getEntry returns the saved entry for the event, or nil if none exists.
+func (c *cache) getEntry(e *event.Notification) (*eventTicket, error) {
 	if *debug {
 		log.Printf("%x cache: get event", eventID(e))
 	}
 
-	eID := eventID(e)
+	eID := c.key(e)
 
 	var et *eventTicket
-	err := c.DB.View(func(tx *bolt.Tx) error {
+	err := c.Store.View(func(tx StoreTx) error {
 		var err error // declare it here so we can use = instead of := to prevent shadowing
-		eventBucket := tx.Bucket([]byte(eventBucketName))
-		if eventBucket == nil {
-			return nil
-		}
 
-		x := eventBucket.Get(eID)
+		x := tx.Get(eventBucketName, eID)
 		// if we don't have a saved event just return nil
 		if x == nil {
 			return nil
@@ -100,38 +325,71 @@ func (c *cache) getEventTicket(e *event.Notification) (*event.Notification, int,
 	})
 
 	if err != nil {
-		return nil, -1, err
-	}
-
-	if et == nil {
-		return nil, -1, nil
+		return nil, err
 	}
 
-	return et.Event, et.TicketID, nil
+	return et, nil
 }
 
+// updateEventTicket saves the event and its ticket. The creation time and escalations of an existing entry for the
+// same ticket are kept.
 func (c *cache) updateEventTicket(e *event.Notification, ticketID int) error {
 	if *debug {
 		log.Printf("%x cache: update event", eventID(e))
 	}
 
-	eID := eventID(e)
+	et := &eventTicket{Event: e, TicketID: ticketID, Created: time.Now()}
 
-	err := c.DB.Update(func(tx *bolt.Tx) error {
-		hostBucket, err := tx.CreateBucketIfNotExists([]byte(eventBucketName))
-		if err != nil {
-			return err
+	return c.Store.Update(func(tx StoreTx) error {
+		var old *eventTicket
+		if x := tx.Get(eventBucketName, c.key(e)); x != nil {
+			var err error
+			old, err = decodeEventTicket(x)
+			if err != nil {
+				return err
+			}
 		}
 
-		x, err := encodeEventTicket(&eventTicket{Event: e, TicketID: ticketID})
-		if err != nil {
-			return err
+		if old != nil && old.TicketID == ticketID {
+			et.Created = old.Created
+			et.Escalated = old.Escalated
+			et.TicketStatus = old.TicketStatus
+			et.History = old.History
 		}
 
-		return hostBucket.Put(eID, x)
+		return c.putEntryTx(tx, et)
 	})
+}
 
-	return err
+// putEntry saves the entry, replacing an existing entry for its event.
+func (c *cache) putEntry(et *eventTicket) error {
+	if *debug {
+		log.Printf("%x cache: update event", eventID(et.Event))
+	}
+
+	return c.Store.Update(func(tx StoreTx) error {
+		return c.putEntryTx(tx, et)
+	})
+}
+
+// putEntryTx saves the entry in tx, updating the ticket index.
+func (c *cache) putEntryTx(tx StoreTx, et *eventTicket) error {
+	eID := c.key(et.Event)
+
+	if err := unindexEntry(tx, eID); err != nil {
+		return err
+	}
+
+	x, err := encodeEventTicket(et)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Put(eventBucketName, eID, x); err != nil {
+		return err
+	}
+
+	return indexTicket(tx, et.TicketID, eID)
 }
 
 func (c *cache) deleteEventTicket(e *event.Notification) error {
@@ -139,79 +397,248 @@ func (c *cache) deleteEventTicket(e *event.Notification) error {
 		log.Printf("%x cache: delete event", eventID(e))
 	}
 
-	eID := eventID(e)
+	eID := c.key(e)
 
-	err := c.DB.Update(func(tx *bolt.Tx) error {
-		hostBucket, err := tx.CreateBucketIfNotExists([]byte(eventBucketName))
-		if err != nil {
-			return err
+	return c.Store.Update(func(tx StoreTx) error {
+		return deleteEntryTx(tx, eID)
+	})
+}
+
+// deleteEntryTx deletes the entry of the key and its ticket index in the transaction.
+func deleteEntryTx(tx StoreTx, key []byte) error {
+	if err := unindexEntry(tx, key); err != nil {
+		return err
+	}
+
+	return tx.Delete(eventBucketName, key)
+}
+
+// entryFilter selects cache entries, empty fields match every entry.
+type entryFilter struct {
+	host    string
+	service string
+	// ticketID matches every ticket if 0, RT doesn't use it.
+	ticketID int
+}
+
+func (f entryFilter) match(et *eventTicket) bool {
+	if f.host != "" && f.host != et.Event.Host {
+		return false
+	}
+
+	if f.service != "" && f.service != et.Event.Service {
+		return false
+	}
+
+	return f.ticketID == 0 || f.ticketID == et.TicketID
+}
+
+// listEntries returns the cache entries matching the filter, ordered by their keys.
+func (c *cache) listEntries(f entryFilter) ([]*eventTicket, error) {
+	lookup := c.allEntries
+	if f.ticketID != 0 {
+		lookup = func() ([]*eventTicket, error) { return c.lookupTicket(f.ticketID) }
+	}
+
+	ets, err := lookup()
+	if err != nil {
+		return nil, err
+	}
+
+	xs := []*eventTicket{}
+	for _, v := range ets {
+		if f.match(v) {
+			xs = append(xs, v)
 		}
+	}
 
-		return hostBucket.Delete(eID)
-	})
+	return xs, nil
+}
 
-	return err
+// setTicket sets the ticket of the entry of the event, replacing the ticket of an existing entry.
+func (c *cache) setTicket(e *event.Notification, ticketID int) error {
+	old, err := c.getEntry(e)
+	if err != nil {
+		return err
+	}
+
+	// keep the last event of an existing entry.
+	if old != nil {
+		e = old.Event
+	}
+
+	return c.updateEventTicket(e, ticketID)
 }
 
-func (c *cache) WriteTo(w io.Writer) (int64, error) {
-	err := c.DB.View(func(tx *bolt.Tx) error {
-		eventBucket := tx.Bucket([]byte(eventBucketName))
-		if eventBucket == nil {
-			return nil
+// purgeClosed deletes the entries whose tickets have a status of closedStatus, returning the deleted entries.
+// Entries of tickets which can't be fetched are kept.
+func (c *cache) purgeClosed(rtClient rtClient, closedStatus []string) ([]*eventTicket, error) {
+	ets, err := c.allEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	closed := make(map[string]bool, len(closedStatus))
+	for _, v := range closedStatus {
+		closed[v] = true
+	}
+
+	purged := []*eventTicket{}
+	for _, v := range ets {
+		if v.TicketID == -1 {
+			continue
+		}
+
+		ticket, err := rtClient.Ticket(v.TicketID)
+		if err != nil {
+			log.Printf("cache: couldn't get ticket #%v of %s: %v", v.TicketID, c.key(v.Event), err)
+			continue
+		}
+
+		if !closed[ticket.Status] {
+			continue
+		}
+
+		if err := c.deleteEventTicket(v.Event); err != nil {
+			return purged, err
 		}
 
-		enc := json.NewEncoder(w)
+		purged = append(purged, v)
+	}
+
+	return purged, nil
+}
+
+// allEntries returns all saved entries.
+func (c *cache) allEntries() ([]*eventTicket, error) {
+	ets := []*eventTicket{}
 
-		c := eventBucket.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+	err := c.Store.View(func(tx StoreTx) error {
+		return tx.ForEach(eventBucketName, nil, func(k, v []byte) error {
 			et, err := decodeEventTicket(v)
 			if err != nil {
 				return err
 			}
-			err = enc.Encode(et)
-			if err != nil {
-				return err
-			}
+
+			ets = append(ets, et)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ets, nil
+}
+
+// pendingEvent is a helper struct for saving delayed ticket creations to the cache
+type pendingEvent struct {
+	Event *event.Notification
+	// Members of the group, if the event is for a group of events.
+	Members map[string]event.State
+	// Due is the time the ticket should be created.
+	Due time.Time
+}
+
+// decodePendingEvent decodes a JSON record, or a gob encoded pending event saved by an older version.
+func decodePendingEvent(x []byte) (*pendingEvent, error) {
+	if isRecord(x) {
+		return unmarshalPendingRecord(x)
+	}
+
+	var p pendingEvent
+	buf := bytes.NewBuffer(x)
+	d := gob.NewDecoder(buf)
+
+	if err := d.Decode(&p); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func encodePendingEvent(p *pendingEvent) ([]byte, error) {
+	return marshalPendingRecord(p)
+}
+
+// getPending returns the pending creation for the event, or nil if none exists.
+func (c *cache) getPending(e *event.Notification) (*pendingEvent, error) {
+	if *debug {
+		log.Printf("%x cache: get pending event", eventID(e))
+	}
+
+	eID := c.key(e)
+
+	var p *pendingEvent
+	err := c.Store.View(func(tx StoreTx) error {
+		var err error
+
+		x := tx.Get(pendingBucketName, eID)
+		if x == nil {
+			return nil
 		}
 
-		return nil
+		p, err = decodePendingEvent(x)
+		return err
 	})
 
-	return 0, err
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
 }
 
-func (c *cache) ReadFrom(r io.Reader) (int64, error) {
-	err := c.DB.Update(func(tx *bolt.Tx) error {
-		eventBucket, err := tx.CreateBucketIfNotExists([]byte(eventBucketName))
+// putPending saves the pending creation, replacing an existing one for its event.
+func (c *cache) putPending(p *pendingEvent) error {
+	if *debug {
+		log.Printf("%x cache: update pending event", eventID(p.Event))
+	}
+
+	eID := c.key(p.Event)
+
+	err := c.Store.Update(func(tx StoreTx) error {
+		x, err := encodePendingEvent(p)
 		if err != nil {
 			return err
 		}
 
-		et := &eventTicket{}
-		dec := json.NewDecoder(r)
-		for {
-			err := dec.Decode(et)
-			if err != nil {
-				if err == io.EOF {
-					return nil
-				}
-				return err
-			}
+		return tx.Put(pendingBucketName, eID, x)
+	})
 
-			log.Printf("%#v", et)
+	return err
+}
 
-			x, err := encodeEventTicket(et)
-			if err != nil {
-				return err
-			}
+func (c *cache) deletePending(e *event.Notification) error {
+	if *debug {
+		log.Printf("%x cache: delete pending event", eventID(e))
+	}
+
+	eID := c.key(e)
+
+	err := c.Store.Update(func(tx StoreTx) error {
+		return tx.Delete(pendingBucketName, eID)
+	})
 
-			eID := eventID(et.Event)
-			err = eventBucket.Put(eID, x)
+	return err
+}
+
+// allPending returns all pending creations.
+func (c *cache) allPending() ([]*pendingEvent, error) {
+	ps := []*pendingEvent{}
+
+	err := c.Store.View(func(tx StoreTx) error {
+		return tx.ForEach(pendingBucketName, nil, func(k, v []byte) error {
+			p, err := decodePendingEvent(v)
 			if err != nil {
 				return err
 			}
-		}
+
+			ps = append(ps, p)
+			return nil
+		})
 	})
 
-	return 0, err
+	return ps, err
 }
@@ -2,11 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/gob"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/bytemine/go-icinga2/event"
 )
@@ -41,14 +42,50 @@ func TestEncodeDecode(t *testing.T) {
 	}
 }
 
+// gobEncode encodes x like older versions of icinga2rt saved cache entries.
+func gobEncode(x interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(x); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func TestDecodeGob(t *testing.T) {
+	x, err := gobEncode(&eventTicket{Event: testEvent, TicketID: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	et, err := decodeEventTicket(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if et.Event.Host != testEvent.Host || et.Event.Service != testEvent.Service || et.TicketID != 1234 {
+		t.Errorf("unexpected entry: %+v", et)
+	}
+}
+
+// countKeys returns the number of keys of the bucket.
+func countKeys(tx StoreTx, bucket string) int {
+	n := 0
+	tx.ForEach(bucket, nil, func(k, v []byte) error {
+		n++
+		return nil
+	})
+	return n
+}
+
 func tempCache() (*cache, string, error) {
-	path, err := ioutil.TempDir("", "icinga2rt")
+	path, err := os.MkdirTemp("", "icinga2rt")
 	if err != nil {
 		return nil, "", err
 	}
 
 	path = filepath.Join(path, "icinga2rt.bolt")
-	c, err := openCache(path)
+	c, err := openCache(path, "")
 	return c, path, err
 }
 
@@ -172,3 +209,137 @@ func TestDeleteEventTicket(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCacheKey(t *testing.T) {
+	c := &cache{}
+
+	tests := []struct {
+		Event *event.Notification
+		Key   string
+	}{
+		{Event: &event.Notification{Host: "example.com", Service: "example"}, Key: "service/example.com/example"},
+		{Event: &event.Notification{Host: "example.com"}, Key: "host/example.com"},
+		{Event: &event.Notification{Host: "a/b", Service: "c d"}, Key: "service/a%2Fb/c%20d"},
+	}
+
+	for _, v := range tests {
+		if key := string(c.key(v.Event)); key != v.Key {
+			t.Errorf("got key %v, expected %v", key, v.Key)
+		}
+	}
+
+	if bytes.Equal(c.key(&event.Notification{Host: "ab", Service: "c"}), c.key(&event.Notification{Host: "a", Service: "bc"})) {
+		t.Error("keys of different events are equal")
+	}
+
+	c.namespace = "icinga/dc1"
+	if key := string(c.key(testEvent)); key != "icinga%2Fdc1/service/example.com/example" {
+		t.Errorf("unexpected key with namespace: %v", key)
+	}
+}
+
+func TestCacheMigrate(t *testing.T) {
+	cache, path, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cache is reopened below, so the last one is removed.
+	defer func() { removeCache(cache, path) }()
+
+	pending := &event.Notification{Host: "example.com", Service: "pending"}
+
+	// simulate a cache of an older version, using hashed keys and no meta bucket.
+	err = cache.Store.Update(func(tx StoreTx) error {
+		if err := tx.DeleteBucket(metaBucketName); err != nil {
+			return err
+		}
+
+		x, err := gobEncode(&eventTicket{Event: testEvent, TicketID: 1234})
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Put(eventBucketName, eventID(testEvent), x); err != nil {
+			return err
+		}
+
+		x, err = gobEncode(&pendingEvent{Event: pending})
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Put(pendingBucketName, eventID(pending), x); err != nil {
+			return err
+		}
+
+		// an entry which can't be decoded doesn't keep the cache from being opened.
+		return tx.Put(eventBucketName, []byte("broken"), []byte{0xff, 0x00, 0x01})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, namespace := range []string{"", "dc1"} {
+		cache, err = openCache(path, namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, ticketID, err := cache.getEventTicket(testEvent)
+		if err != nil || ticketID != 1234 {
+			t.Errorf("namespace %q: entry wasn't migrated: #%v %v", namespace, ticketID, err)
+		}
+
+		p, err := cache.getPending(pending)
+		if err != nil || p == nil {
+			t.Errorf("namespace %q: pending event wasn't migrated: %v", namespace, err)
+		}
+
+		err = cache.Store.View(func(tx StoreTx) error {
+			if string(tx.Get(metaBucketName, []byte(metaSchemaVersion))) != cacheSchemaVersion || string(tx.Get(metaBucketName, []byte(metaNamespace))) != namespace {
+				t.Errorf("namespace %q: meta wasn't recorded", namespace)
+			}
+
+			if n := countKeys(tx, eventBucketName); n != 1 {
+				t.Errorf("namespace %q: expected 1 entry, got %v", namespace, n)
+			}
+
+			if x := tx.Get(eventBucketName, cache.key(testEvent)); !isRecord(x) {
+				t.Errorf("namespace %q: entry wasn't converted to a record: %q", namespace, x)
+			}
+
+			if x := tx.Get(quarantineBucketName, quarantineKey(eventBucketName, []byte("broken"))); x == nil {
+				t.Errorf("namespace %q: broken entry wasn't quarantined", namespace)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		as, err := cache.getAudit(testEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the audit entry is saved with the first namespace.
+		if namespace != "" && (len(as) != 1 || as[0].Action != "create") {
+			t.Errorf("namespace %q: audit entry wasn't migrated: %+v", namespace, as)
+		}
+
+		if namespace == "" {
+			if err := cache.putAudit(testEvent, &auditEntry{Time: time.Now(), Action: "create"}, 0, time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := cache.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+// quarantineBucketName is the bucket bad records are moved to by a repair or the migration, keyed by their bucket
+// and key.
+const quarantineBucketName = "quarantine"
+
+// checkIssue is a problem of a record found by the integrity check.
+type checkIssue struct {
+	bucket string
+	key    []byte
+	reason string
+	// quarantine is set if the record is moved to the quarantine bucket by a repair.
+	quarantine bool
+	// repaired is set if the issue was repaired.
+	repaired bool
+}
+
+// String returns the bucket and a readable form of the key with the reason.
+func (i checkIssue) String() string {
+	key := string(i.key)
+
+	switch i.bucket {
+	case auditBucketName:
+		// the event key and the sequence number.
+		if n := len(i.key) - 9; n >= 0 {
+			key = fmt.Sprintf("%s #%v", i.key[:n], binary.BigEndian.Uint64(i.key[n+1:]))
+		}
+	case ticketIndexBucketName:
+		// the ticket and the event key.
+		if len(i.key) >= 8 {
+			key = fmt.Sprintf("#%v %s", binary.BigEndian.Uint64(i.key[:8]), i.key[8:])
+		}
+	}
+
+	if i.repaired {
+		return fmt.Sprintf("%v %v: %v, repaired", i.bucket, key, i.reason)
+	}
+
+	return fmt.Sprintf("%v %v: %v", i.bucket, key, i.reason)
+}
+
+// checkReport are the results of the integrity check.
+type checkReport struct {
+	// records is the number of records checked.
+	records     int
+	issues      []checkIssue
+	quarantined int
+}
+
+// quarantineKey is the key of a record of the bucket in the quarantine bucket.
+func quarantineKey(bucket string, key []byte) []byte {
+	return append([]byte(bucket+"/"), key...)
+}
+
+// check walks all buckets and reports undecodable records, entries without valid ticket, tickets used by several
+// entries which aren't folded and index keys without entry, which are repaired by rebuilding the index. Records in
+// the quarantine bucket are listed too. If rtClient isn't nil, the tickets of the entries are fetched and entries of
+// tickets which don't exist are reported. With repair, undecodable records, entries without valid ticket and
+// entries of tickets which don't exist are moved to the quarantine bucket.
+func (c *cache) check(rtClient rtClient, repair bool) (*checkReport, error) {
+	report := &checkReport{}
+
+	// keys of the entries by their ticket.
+	tickets := map[int][]string{}
+	// keys of the entries which aren't folded by their ticket.
+	owners := map[int][]string{}
+
+	err := c.Store.View(func(tx StoreTx) error {
+		err := tx.ForEach(eventBucketName, nil, func(k, v []byte) error {
+			report.records++
+
+			et, err := decodeEventTicket(v)
+			if err != nil {
+				report.issues = append(report.issues, checkIssue{bucket: eventBucketName, key: append([]byte{}, k...), reason: fmt.Sprintf("can't decode: %v", err), quarantine: true})
+				return nil
+			}
+
+			if et.TicketID < 1 {
+				report.issues = append(report.issues, checkIssue{bucket: eventBucketName, key: append([]byte{}, k...), reason: fmt.Sprintf("invalid ticket #%v", et.TicketID), quarantine: true})
+				return nil
+			}
+
+			tickets[et.TicketID] = append(tickets[et.TicketID], string(k))
+			if !et.Folded {
+				owners[et.TicketID] = append(owners[et.TicketID], string(k))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.ForEach(pendingBucketName, nil, func(k, v []byte) error {
+			report.records++
+
+			if _, err := decodePendingEvent(v); err != nil {
+				report.issues = append(report.issues, checkIssue{bucket: pendingBucketName, key: append([]byte{}, k...), reason: fmt.Sprintf("can't decode: %v", err), quarantine: true})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.ForEach(auditBucketName, nil, func(k, v []byte) error {
+			report.records++
+
+			var a auditEntry
+			if err := json.Unmarshal(v, &a); err != nil {
+				report.issues = append(report.issues, checkIssue{bucket: auditBucketName, key: append([]byte{}, k...), reason: fmt.Sprintf("can't decode: %v", err), quarantine: true})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// the index is rebuilt by a repair.
+		err = tx.ForEach(ticketIndexBucketName, nil, func(k, v []byte) error {
+			report.records++
+
+			if len(k) < 8 || tx.Get(eventBucketName, k[8:]) == nil {
+				report.issues = append(report.issues, checkIssue{bucket: ticketIndexBucketName, key: append([]byte{}, k...), reason: "no entry"})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// records moved by the migration, which couldn't decode them, or by an earlier repair. They are kept for
+		// inspection and aren't issues left.
+		return tx.ForEach(quarantineBucketName, nil, func(k, v []byte) error {
+			report.issues = append(report.issues, checkIssue{bucket: quarantineBucketName, key: append([]byte{}, k...), reason: "in quarantine"})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(tickets))
+	for k := range tickets {
+		ids = append(ids, k)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if keys := owners[id]; len(keys) > 1 {
+			for _, k := range keys[1:] {
+				report.issues = append(report.issues, checkIssue{bucket: eventBucketName, key: []byte(k), reason: fmt.Sprintf("ticket #%v is also used by %v", id, keys[0])})
+			}
+		}
+
+		if rtClient == nil {
+			continue
+		}
+
+		_, err := rtClient.Ticket(id)
+		switch {
+		case err == rt.ErrNotFound:
+			for _, k := range tickets[id] {
+				report.issues = append(report.issues, checkIssue{bucket: eventBucketName, key: []byte(k), reason: fmt.Sprintf("ticket #%v doesn't exist in RT", id), quarantine: true})
+			}
+		case err != nil:
+			// RT may be unreachable, the entries are kept.
+			for _, k := range tickets[id] {
+				report.issues = append(report.issues, checkIssue{bucket: eventBucketName, key: []byte(k), reason: fmt.Sprintf("couldn't fetch ticket #%v: %v", id, err)})
+			}
+		}
+	}
+
+	if !repair {
+		return report, nil
+	}
+
+	err = c.Store.Update(func(tx StoreTx) error {
+		for i, v := range report.issues {
+			if !v.quarantine {
+				continue
+			}
+
+			x := tx.Get(v.bucket, v.key)
+			if x == nil {
+				continue
+			}
+
+			if err := tx.Put(quarantineBucketName, quarantineKey(v.bucket, v.key), x); err != nil {
+				return err
+			}
+
+			if err := tx.Delete(v.bucket, v.key); err != nil {
+				return err
+			}
+
+			report.issues[i].repaired = true
+			report.quarantined++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if _, err := c.checkTicketIndex(); err != nil {
+		return report, err
+	}
+
+	for i, v := range report.issues {
+		if v.bucket == ticketIndexBucketName {
+			report.issues[i].repaired = true
+		}
+	}
+
+	return report, nil
+}
+
+// left returns the number of issues which weren't repaired, not counting records in the quarantine bucket.
+func (r *checkReport) left() int {
+	n := 0
+	for _, v := range r.issues {
+		if !v.repaired && v.bucket != quarantineBucketName {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+func TestCacheCheck(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	// the first ticket is #0, which isn't used by RT.
+	dummy := NewDummyRT()
+	for i := 0; i < 3; i++ {
+		if _, err := dummy.NewTicket(&rt.Ticket{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	putTestEntries(t, cache, map[string]int{"example.com/http": 1, "example.com/ssh": 1, "example.com": 2, "example.com/smtp": 9, "example.com/ftp": 0})
+
+	folded := &eventTicket{Event: newTestEvent("example.com", "disk", event.StateCritical), TicketID: 2, Folded: true}
+	if err := cache.putEntry(folded); err != nil {
+		t.Fatal(err)
+	}
+
+	garbage := []byte{0xff, 0x00, 0x01}
+	err = cache.Store.Update(func(tx StoreTx) error {
+		if err := tx.Put(eventBucketName, []byte("service/example.com/broken"), garbage); err != nil {
+			return err
+		}
+
+		if err := tx.Put(pendingBucketName, []byte("service/example.com/broken"), garbage); err != nil {
+			return err
+		}
+
+		if err := tx.Put(auditBucketName, auditKey([]byte("service/example.com/broken"), 1), garbage); err != nil {
+			return err
+		}
+
+		return tx.Put(ticketIndexBucketName, ticketIndexKey(3, []byte("service/example.com/gone")), []byte{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := cache.check(dummy, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// broken entry, pending event and audit entry, ticket #0, duplicate #1, missing #9 and the index key.
+	if len(report.issues) != 7 || report.left() != 7 {
+		t.Errorf("expected 7 issues, got %v", report.issues)
+	}
+
+	var out bytes.Buffer
+	env := &commandEnv{cache: cache, rtClient: func() (rtClient, error) { return dummy, nil }, out: &out}
+
+	if err := runCommand(env, []string{"cache", "check", "-repair"}); err == nil || !strings.Contains(err.Error(), "1 issues left") {
+		t.Errorf("expected the duplicate to be left, got %v", err)
+	}
+
+	if x := out.String(); !strings.Contains(x, "service/example.com/ssh: ticket #1 is also used by service/example.com/http\n") ||
+		!strings.Contains(x, "audit service/example.com/broken #1: can't decode") || !strings.Contains(x, "5 quarantined") {
+		t.Errorf("unexpected report:\n%v", x)
+	}
+
+	report, err = cache.check(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and the quarantined records.
+	if len(report.issues) != 6 || report.left() != 1 {
+		t.Errorf("expected only the duplicate after the repair, got %v", report.issues)
+	}
+
+	err = cache.Store.View(func(tx StoreTx) error {
+		if n := countKeys(tx, quarantineBucketName); n != 5 {
+			t.Errorf("expected 5 quarantined records, got %v", n)
+		}
+
+		if x := tx.Get(quarantineBucketName, quarantineKey(eventBucketName, []byte("service/example.com/broken"))); !bytes.Equal(x, garbage) {
+			t.Errorf("expected the quarantined record, got %x", x)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheCheckMigrated(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cache is reopened below, so the last one is removed.
+	defer func() { removeCache(cache, cachePath) }()
+
+	// a cache of an older version with an entry the migration can't decode.
+	err = cache.Store.Update(func(tx StoreTx) error {
+		if err := tx.DeleteBucket(metaBucketName); err != nil {
+			return err
+		}
+
+		return tx.Put(eventBucketName, []byte("broken"), []byte{0xff, 0x00, 0x01})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = openCache(cachePath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	env := &commandEnv{cache: cache, out: &out}
+
+	if err := runCommand(env, []string{"cache", "check", "-skip-rt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if x := out.String(); !strings.Contains(x, "quarantine events/broken: in quarantine\n") {
+		t.Errorf("unexpected report:\n%v", x)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+// commandEnv is used by subcommands.
+type commandEnv struct {
+	cache *cache
+	conf  *config
+	// rtClient connects to RT, it's only called by commands using RT.
+	rtClient func() (rtClient, error)
+	// objects connects to the Icinga2 objects API, it's only called by commands using it.
+	objects func() (objectsClient, error)
+	in      io.Reader
+	out     io.Writer
+}
+
+// runCommand runs the subcommand given by the arguments left after the flags.
+func runCommand(env *commandEnv, args []string) error {
+	switch args[0] {
+	case "audit":
+		return auditCommand(env.cache, args[1:], env.out)
+	case "cache":
+		return cacheCommand(env, args[1:])
+	default:
+		return fmt.Errorf("unknown command %v", args[0])
+	}
+}
+
+const cacheUsage = `usage:
+	cache list [-host host] [-service service] [-ticket id]
+	cache show <host> [service]
+	cache set [-state state] <ticket> <host> [service]
+	cache delete <host> [service]
+	cache purge
+	cache gc [-dry-run]
+	cache export [-format jsonl|csv] [-host host] [-service service] [-ticket id] [file]
+	cache import [-mode merge|replace|skip-existing] [-verify] [-dry-run] [file]
+	cache backup [dir]
+	cache restore <snapshot>
+	cache check [-skip-rt] [-repair]`
+
+// cacheCommand runs the cache subcommand with its arguments, see cacheUsage.
+func cacheCommand(env *commandEnv, args []string) error {
+	if len(args) == 0 {
+		return errors.New(cacheUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		return cacheList(env, args[1:])
+	case "show":
+		return cacheShow(env, args[1:])
+	case "set":
+		return cacheSet(env, args[1:])
+	case "delete":
+		return cacheDelete(env, args[1:])
+	case "purge":
+		return cachePurge(env, args[1:])
+	case "gc":
+		return cacheGC(env, args[1:])
+	case "export":
+		return cacheExport(env, args[1:])
+	case "import":
+		return cacheImport(env, args[1:])
+	case "backup":
+		return cacheBackup(env, args[1:])
+	case "restore":
+		return cacheRestore(env, args[1:])
+	case "check":
+		return cacheCheck(env, args[1:])
+	default:
+		return errors.New(cacheUsage)
+	}
+}
+
+// parseObject returns an event of the host and optional service given by args.
+func parseObject(args []string) (*event.Notification, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errors.New(cacheUsage)
+	}
+
+	e := &event.Notification{Host: args[0]}
+	if len(args) == 2 {
+		e.Service = args[1]
+	}
+
+	return e, nil
+}
+
+func cacheList(env *commandEnv, args []string) error {
+	f := entryFilter{}
+
+	flags := flag.NewFlagSet("cache list", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&f.host, "host", "", "host of the entries")
+	flags.StringVar(&f.service, "service", "", "service of the entries")
+	flags.IntVar(&f.ticketID, "ticket", 0, "ticket of the entries")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errors.New(cacheUsage)
+	}
+
+	ets, err := env.cache.listEntries(f)
+	if err != nil {
+		return err
+	}
+
+	return writeEntries(env.out, env.cache, ets)
+}
+
+// writeEntries writes the entries as a table.
+func writeEntries(w io.Writer, c *cache, ets []*eventTicket) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "KEY\tSTATE\tTICKET\tSTATUS\tCREATED")
+	for _, v := range ets {
+		ticket := "-"
+		if v.TicketID != -1 {
+			ticket = fmt.Sprintf("#%v", v.TicketID)
+		}
+
+		created := "-"
+		if !v.Created.IsZero() {
+			created = v.Created.Local().Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%v\t%v\n", c.key(v.Event), orDash(stateString(v.Event)), ticket, orDash(v.TicketStatus), created)
+	}
+
+	return tw.Flush()
+}
+
+func cacheShow(env *commandEnv, args []string) error {
+	e, err := parseObject(args)
+	if err != nil {
+		return err
+	}
+
+	et, err := env.cache.getEntry(e)
+	if err != nil {
+		return err
+	}
+
+	if et == nil {
+		return fmt.Errorf("no entry %s", env.cache.key(e))
+	}
+
+	x, err := json.MarshalIndent(newTicketRecord(et), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(env.out, string(x))
+	return err
+}
+
+func cacheSet(env *commandEnv, args []string) error {
+	flags := flag.NewFlagSet("cache set", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	state := flags.String("state", "", "state of a new entry: OK, WARNING, CRITICAL or UNKNOWN")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() < 2 {
+		return errors.New(cacheUsage)
+	}
+
+	ticketID, err := strconv.Atoi(flags.Arg(0))
+	if err != nil || ticketID < 1 {
+		return fmt.Errorf("invalid ticket: %v", flags.Arg(0))
+	}
+
+	e, err := parseObject(flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	old, err := env.cache.getEntry(e)
+	if err != nil {
+		return err
+	}
+
+	if old == nil {
+		e.CheckResult.State = event.NewState(*state)
+		if e.CheckResult.State == event.StateNil {
+			return fmt.Errorf("no entry %s, a new one needs -state", env.cache.key(e))
+		}
+
+		// the host of a new entry is reachable, it's only used for host states.
+		e.CheckResult.VarsAfter.Reachable = true
+	}
+
+	if err := env.cache.setTicket(e, ticketID); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(env.out, "set ticket of %s to #%v\n", env.cache.key(e), ticketID)
+	return err
+}
+
+func cacheDelete(env *commandEnv, args []string) error {
+	e, err := parseObject(args)
+	if err != nil {
+		return err
+	}
+
+	et, err := env.cache.getEntry(e)
+	if err != nil {
+		return err
+	}
+
+	if et == nil {
+		return fmt.Errorf("no entry %s", env.cache.key(e))
+	}
+
+	if err := env.cache.deleteEventTicket(e); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(env.out, "deleted %s\n", env.cache.key(e))
+	return err
+}
+
+func cachePurge(env *commandEnv, args []string) error {
+	if len(args) != 0 {
+		return errors.New(cacheUsage)
+	}
+
+	rtClient, err := env.rtClient()
+	if err != nil {
+		return err
+	}
+
+	purged, err := env.cache.purgeClosed(rtClient, env.conf.Ticket.ClosedStatus)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range purged {
+		fmt.Fprintf(env.out, "deleted %s of closed ticket #%v\n", env.cache.key(v.Event), v.TicketID)
+	}
+
+	_, err = fmt.Fprintf(env.out, "purged %v entries\n", len(purged))
+	return err
+}
+
+// cacheGC collects garbage once, like configured in Cache.GC, ignoring its interval.
+func cacheGC(env *commandEnv, args []string) error {
+	flags := flag.NewFlagSet("cache gc", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	dryRun := flags.Bool("dry-run", false, "only report the entries which would be removed")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errors.New(cacheUsage)
+	}
+
+	if env.conf.Cache.GC.ttl <= 0 {
+		return fmt.Errorf("Cache.GC.TTL must be > 0.")
+	}
+
+	rtClient, err := env.rtClient()
+	if err != nil {
+		return err
+	}
+
+	tu := newTicketUpdater(env.cache, rtClient, nil, env.conf.Ticket.Nobody, env.conf.Ticket.Queue, env.conf.Ticket.ClosedStatus)
+	tu.grouping = env.conf.Ticket.Grouping
+	tu.reopenWindow = env.conf.Ticket.reopenWindow
+	tu.gc = newGC(env.conf.Cache.GC)
+
+	if env.conf.Cache.GC.Objects {
+		tu.objects, err = env.objects()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !env.conf.Cache.Audit.Disable {
+		tu.audit = newAudit(env.conf.Cache.Audit)
+	}
+
+	removed, err := tu.collectGarbage(*dryRun)
+
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+
+	for _, v := range removed {
+		fmt.Fprintf(env.out, "%v %s: %v\n", verb, env.cache.key(v.entry.Event), v.reason)
+	}
+
+	return err
+}
+
+// cacheExport writes the entries to the file, or to the output if it's omitted or "-".
+func cacheExport(env *commandEnv, args []string) error {
+	f := entryFilter{}
+
+	flags := flag.NewFlagSet("cache export", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	format := flags.String("format", formatJSONL, "format of the entries: jsonl or csv")
+	flags.StringVar(&f.host, "host", "", "host of the entries")
+	flags.StringVar(&f.service, "service", "", "service of the entries")
+	flags.IntVar(&f.ticketID, "ticket", 0, "ticket of the entries")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return errors.New(cacheUsage)
+	}
+
+	if flags.NArg() == 0 || flags.Arg(0) == "-" {
+		_, err := env.cache.export(env.out, *format, f)
+		return err
+	}
+
+	file, err := os.Create(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	n, err := env.cache.export(file, *format, f)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(env.out, "wrote %v bytes to %v\n", n, flags.Arg(0))
+	return err
+}
+
+// cacheImport reads the entries of a JSONL export from the file, or from the input if it's omitted or "-".
+func cacheImport(env *commandEnv, args []string) error {
+	opts := importOptions{}
+
+	flags := flag.NewFlagSet("cache import", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&opts.mode, "mode", importMerge, "how existing entries are handled: merge, replace or skip-existing")
+	verify := flags.Bool("verify", false, "check that the tickets of the entries exist in RT")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "only report the changes")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return errors.New(cacheUsage)
+	}
+
+	if *verify {
+		var err error
+		opts.rt, err = env.rtClient()
+		if err != nil {
+			return err
+		}
+	}
+
+	r := env.in
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		r = file
+	}
+
+	report, n, err := env.cache.importEntries(r, opts)
+	if err != nil {
+		return err
+	}
+
+	return writeImportReport(env.out, report, n, opts.dryRun)
+}
+
+// writeImportReport writes the changes of an import and a summary.
+func writeImportReport(w io.Writer, report *importReport, n int64, dryRun bool) error {
+	for _, v := range report.added {
+		fmt.Fprintf(w, "added %s\n", v)
+	}
+
+	for _, v := range report.changed {
+		fmt.Fprintf(w, "changed %s\n", v)
+	}
+
+	for _, v := range report.removed {
+		fmt.Fprintf(w, "removed %s\n", v)
+	}
+
+	for _, v := range report.conflicts {
+		fmt.Fprintf(w, "conflict %s: %v\n", v.key, v.reason)
+	}
+
+	summary := fmt.Sprintf("read %v bytes: %v added, %v changed, %v removed, %v unchanged, %v conflicts", n, len(report.added), len(report.changed), len(report.removed), report.unchanged, len(report.conflicts))
+	if dryRun {
+		summary += ", dry run, nothing was written"
+	}
+
+	_, err := fmt.Fprintln(w, summary)
+	return err
+}
+
+// cacheBackup writes a snapshot to the directory, or to Cache.Backup.Dir if it's omitted.
+func cacheBackup(env *commandEnv, args []string) error {
+	if len(args) > 1 {
+		return errors.New(cacheUsage)
+	}
+
+	dir := env.conf.Cache.Backup.Dir
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	if dir == "" {
+		return fmt.Errorf("no directory given and Cache.Backup.Dir isn't set")
+	}
+
+	path, n, err := env.cache.backup(dir, env.conf.Cache.Backup.Keep, env.conf.Cache.Backend, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(env.out, "wrote backup %v, %v bytes\n", path, n)
+	return err
+}
+
+// cacheRestore replaces the cache with the snapshot.
+func cacheRestore(env *commandEnv, args []string) error {
+	if len(args) != 1 {
+		return errors.New(cacheUsage)
+	}
+
+	if err := env.cache.restore(env.conf.Cache, args[0]); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(env.out, "restored %v from %v\n", env.conf.Cache.File, args[0])
+	return err
+}
+
+// cacheCheck checks the integrity of the cache and prints the issues found. It fails if issues are left, so it can
+// be used in scripts.
+func cacheCheck(env *commandEnv, args []string) error {
+	flags := flag.NewFlagSet("cache check", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	skipRT := flags.Bool("skip-rt", false, "don't check that the tickets exist in RT")
+	repair := flags.Bool("repair", false, "move bad records to the quarantine bucket")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errors.New(cacheUsage)
+	}
+
+	var rtClient rtClient
+	if !*skipRT {
+		var err error
+		rtClient, err = env.rtClient()
+		if err != nil {
+			return err
+		}
+	}
+
+	report, err := env.cache.check(rtClient, *repair)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range report.issues {
+		fmt.Fprintln(env.out, v)
+	}
+
+	fmt.Fprintf(env.out, "checked %v records: %v issues, %v quarantined\n", report.records, len(report.issues), report.quarantined)
+
+	if left := report.left(); left > 0 {
+		return fmt.Errorf("%v issues left", left)
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+func TestCacheCommand(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	// the first ticket is #0, which isn't used by RT.
+	dummy := NewDummyRT()
+	for _, v := range []string{"", "open", "resolved"} {
+		if _, err := dummy.NewTicket(&rt.Ticket{Status: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	env := &commandEnv{
+		cache:    cache,
+		conf:     &config{Ticket: ticketConfig{ClosedStatus: []string{"resolved"}}},
+		rtClient: func() (rtClient, error) { return dummy, nil },
+		out:      &out,
+	}
+
+	run := func(args ...string) string {
+		out.Reset()
+		if err := runCommand(env, append([]string{"cache"}, args...)); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out.String()
+	}
+
+	if err := runCommand(env, []string{"cache", "set", "1", "example.com", "http"}); err == nil {
+		t.Error("expected error for new entry without state")
+	}
+
+	run("set", "-state", "CRITICAL", "1", "example.com", "http")
+	run("set", "-state", "WARNING", "5", "example.com", "ssh")
+	// replaces the ticket, keeping the state.
+	run("set", "-state", "OK", "2", "example.com", "ssh")
+
+	e := &event.Notification{Host: "example.com", Service: "ssh"}
+	et, err := cache.getEntry(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if et.TicketID != 2 || et.Event.CheckResult.State != event.StateWarning {
+		t.Errorf("ticket wasn't replaced: %+v %+v", et, et.Event)
+	}
+
+	if x := run("list"); strings.Count(x, "\n") != 3 {
+		t.Errorf("expected 2 entries:\n%v", x)
+	}
+
+	if x := run("list", "-ticket", "2"); strings.Count(x, "\n") != 2 || !strings.Contains(x, "service/example.com/ssh") {
+		t.Errorf("expected entry of ticket 2:\n%v", x)
+	}
+
+	if x := run("list", "-host", "example.org"); strings.Count(x, "\n") != 1 {
+		t.Errorf("expected no entries:\n%v", x)
+	}
+
+	if x := run("show", "example.com", "http"); !strings.Contains(x, `"ticketId": 1`) || !strings.Contains(x, `"state": "CRITICAL"`) {
+		t.Errorf("unexpected entry:\n%v", x)
+	}
+
+	if x := run("purge"); !strings.Contains(x, "purged 1 entries") {
+		t.Errorf("expected 1 purged entry:\n%v", x)
+	}
+
+	if et, err := cache.getEntry(e); err != nil || et != nil {
+		t.Errorf("entry of closed ticket wasn't purged: %+v %v", et, err)
+	}
+
+	run("delete", "example.com", "http")
+
+	if err := runCommand(env, []string{"cache", "delete", "example.com", "http"}); err == nil {
+		t.Error("expected error for missing entry")
+	}
+
+	if err := runCommand(env, []string{"cache", "show", "example.com", "http", "extra"}); err == nil {
+		t.Error("expected usage error")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+// Object types of events.
+const (
+	objectTypeHost    = "host"
+	objectTypeService = "service"
+)
+
+// notificationTypes are the valid notification types of events.
+var notificationTypes = []event.NotificationType{
+	event.NotificationDowntimeStart,
+	event.NotificationDowntimeEnd,
+	event.NotificationDowntimeRemoved,
+	event.NotificationCustom,
+	event.NotificationAcknowledgement,
+	event.NotificationProblem,
+	event.NotificationRecovery,
+	event.NotificationFlappingStart,
+	event.NotificationFlappingEnd,
+	event.NotificationUnknown,
+}
+
+// Host states. Icinga derives them from the check result state and the reachability of hosts.
+const (
+	hostStateUp          = "UP"
+	hostStateDown        = "DOWN"
+	hostStateUnreachable = "UNREACHABLE"
+)
+
+// hostState returns the host state of a host event, or the empty string for service events and nil.
+func hostState(e *event.Notification) string {
+	if e == nil || e.Service != "" || isGroupEvent(e) {
+		return ""
+	}
+
+	switch e.CheckResult.State {
+	case event.StateOK, event.StateWarning:
+		return hostStateUp
+	case event.StateCritical, event.StateUnknown:
+		if !e.CheckResult.VarsAfter.Reachable {
+			return hostStateUnreachable
+		}
+		return hostStateDown
+	default:
+		return ""
+	}
+}
+
+// stateString returns the state of the event, the host state for host events.
+func stateString(e *event.Notification) string {
+	if s := hostState(e); s != "" {
+		return s
+	}
+
+	return e.CheckResult.State.String()
+}
+
+func objectType(e *event.Notification) string {
+	if e.Service == "" {
+		return objectTypeHost
+	}
+
+	return objectTypeService
+}
+
+// values are the sets of values a property must and must not have to match. An empty include set matches any
+// value which isn't excluded. Values are compared case-insensitive.
+type values struct {
+	include []string
+	exclude []string
+}
+
+// wildcard matches any value in mappings and rules.
+const wildcard = "*"
+
+// anyValue matches any value.
+var anyValue values
+
+// oneValue matches only x.
+func oneValue(x string) values {
+	return values{include: []string{x}}
+}
+
+func (v values) match(x string) bool {
+	for _, w := range v.exclude {
+		if strings.EqualFold(w, x) {
+			return false
+		}
+	}
+
+	if len(v.include) == 0 {
+		return true
+	}
+
+	for _, w := range v.include {
+		if strings.EqualFold(w, x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchState is like match, but a host event matches if either its state or its host state matches. Excluded
+// values exclude both.
+func (v values) matchState(state, hostState string) bool {
+	if hostState == "" {
+		return v.match(state)
+	}
+
+	for _, w := range v.exclude {
+		if strings.EqualFold(w, state) || strings.EqualFold(w, hostState) {
+			return false
+		}
+	}
+
+	if len(v.include) == 0 {
+		return true
+	}
+
+	for _, w := range v.include {
+		if strings.EqualFold(w, state) || strings.EqualFold(w, hostState) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchList is like match, but matches a list of values. The list matches if any of its values is included and none
+// is excluded.
+func (v values) matchList(xs []string) bool {
+	for _, x := range xs {
+		for _, w := range v.exclude {
+			if strings.EqualFold(w, x) {
+				return false
+			}
+		}
+	}
+
+	if len(v.include) == 0 {
+		return true
+	}
+
+	for _, x := range xs {
+		for _, w := range v.include {
+			if strings.EqualFold(w, x) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// normalizeState checks if x is a valid service or host state and returns it in the form used by facts.
+func normalizeState(x string) (string, error) {
+	switch strings.ToUpper(x) {
+	case hostStateUp, hostStateDown, hostStateUnreachable:
+		return strings.ToUpper(x), nil
+	}
+
+	// uppercase the value as icingas strings are uppercase
+	state := event.NewState(strings.ToUpper(x))
+	if state == event.StateNil {
+		return "", fmt.Errorf("invalid state value %v", x)
+	}
+
+	return state.String(), nil
+}
+
+// normalizeOldState is like normalizeState, but allows the empty string for events without old state.
+func normalizeOldState(x string) (string, error) {
+	if x == event.StateStringNil {
+		return x, nil
+	}
+
+	return normalizeState(x)
+}
+
+func normalizeOwned(x string) (string, error) {
+	owned, err := parseCSVBool(x)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatBool(owned), nil
+}
+
+func normalizeNotificationType(x string) (string, error) {
+	for _, v := range notificationTypes {
+		if strings.EqualFold(x, string(v)) {
+			return string(v), nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid notification type value %v", x)
+}
+
+func normalizeObjectType(x string) (string, error) {
+	switch strings.ToLower(x) {
+	case objectTypeHost, objectTypeService:
+		return strings.ToLower(x), nil
+	default:
+		return "", fmt.Errorf("invalid object type value %v", x)
+	}
+}
+
+// normalizeString accepts any value, used for free-form values like ticket status and queue.
+func normalizeString(x string) (string, error) {
+	return x, nil
+}
+
+// facts are the properties of an event and its ticket which are matched against conditions.
+// Properties which aren't known, like the old state of a new event, are empty strings.
+// The host states are only set for host events.
+type facts struct {
+	state            string
+	hostState        string
+	oldState         string
+	oldHostState     string
+	owned            string
+	notificationType string
+	objectType       string
+	ticketStatus     string
+	queue            string
+	// schedules are the names of the active schedules.
+	schedules []string
+}
+
+// newFacts returns the facts of the event, old is the previous event of the ticket or nil.
+func newFacts(e *event.Notification, old *event.Notification, owned bool) facts {
+	f := facts{
+		state:            e.CheckResult.State.String(),
+		hostState:        hostState(e),
+		owned:            strconv.FormatBool(owned),
+		notificationType: string(e.NotificationType),
+		objectType:       objectType(e),
+	}
+
+	if old != nil {
+		f.oldState = old.CheckResult.State.String()
+		f.oldHostState = hostState(old)
+	}
+
+	return f
+}
+
+// condition describes the properties an event must have to match.
+type condition struct {
+	state            values
+	oldState         values
+	owned            values
+	notificationType values
+	objectType       values
+	ticketStatus     values
+	queue            values
+	schedule         values
+}
+
+func (c condition) match(f facts) bool {
+	return c.state.matchState(f.state, f.hostState) &&
+		c.oldState.matchState(f.oldState, f.oldHostState) &&
+		c.owned.match(f.owned) &&
+		c.notificationType.match(f.notificationType) &&
+		c.objectType.match(f.objectType) &&
+		c.ticketStatus.match(f.ticketStatus) &&
+		c.queue.match(f.queue) &&
+		c.schedule.matchList(f.schedules)
+}
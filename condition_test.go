@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func TestConditionMatch(t *testing.T) {
+	ms, err := readMappings(strings.NewReader(validExtendedCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Facts   facts
+		Mapping int // index of the first matching mapping, -1 if none matches
+	}{
+		{Facts: facts{state: "OK", oldState: "WARNING", owned: "true", objectType: "host"}, Mapping: 0},
+		{Facts: facts{state: "OK", oldState: "WARNING", owned: "false", notificationType: "ACKNOWLEDGEMENT", objectType: "service", ticketStatus: "Open", queue: "general"}, Mapping: 1},
+		{Facts: facts{state: "OK", oldState: "WARNING", owned: "false", notificationType: "ACKNOWLEDGEMENT", objectType: "service", ticketStatus: "new", queue: "general"}, Mapping: -1},
+		{Facts: newFacts(newTestEvent("example.com", "", event.StateCritical), nil, false), Mapping: -1},
+		{Facts: newFacts(&event.Notification{Host: "example.com", NotificationType: event.NotificationProblem, CheckResult: event.CheckResultData{State: event.StateCritical}}, nil, false), Mapping: 2},
+		{Facts: facts{state: "OK", oldState: "CRITICAL", owned: "true", ticketStatus: "stalled"}, Mapping: 3},
+	}
+
+	for i, v := range tests {
+		matched := -1
+		for j, m := range ms {
+			if m.condition.match(v.Facts) {
+				matched = j
+				break
+			}
+		}
+
+		if matched != v.Mapping {
+			t.Errorf("test %v: matched mapping %v, expected %v", i, matched, v.Mapping)
+		}
+	}
+}
+
+func TestHostState(t *testing.T) {
+	unreachable := newTestEvent("example.com", "", event.StateCritical)
+	unreachable.CheckResult.VarsAfter.Reachable = false
+
+	tests := []struct {
+		Event *event.Notification
+		State string
+	}{
+		{Event: newTestEvent("example.com", "", event.StateOK), State: "UP"},
+		{Event: newTestEvent("example.com", "", event.StateWarning), State: "UP"},
+		{Event: newTestEvent("example.com", "", event.StateCritical), State: "DOWN"},
+		{Event: newTestEvent("example.com", "", event.StateUnknown), State: "DOWN"},
+		{Event: unreachable, State: "UNREACHABLE"},
+		{Event: newTestEvent("example.com", "example", event.StateCritical), State: ""},
+		{Event: nil, State: ""},
+	}
+
+	for i, v := range tests {
+		if s := hostState(v.Event); s != v.State {
+			t.Errorf("test %v: got %v, expected %v", i, s, v.State)
+		}
+	}
+
+	// host events match both service and host states, excluded values exclude both.
+	c := condition{state: values{include: []string{"CRITICAL"}}, oldState: values{exclude: []string{"UP"}}}
+	if !c.match(newFacts(newTestEvent("example.com", "", event.StateCritical), newTestEvent("example.com", "", event.StateCritical), false)) {
+		t.Error("expected match of DOWN host with old state DOWN")
+	}
+
+	if c.match(newFacts(newTestEvent("example.com", "", event.StateCritical), newTestEvent("example.com", "", event.StateOK), false)) {
+		t.Error("unexpected match of excluded old state UP")
+	}
+}
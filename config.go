@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bytemine/go-icinga2/event"
 	"github.com/bytemine/icinga2rt/filter"
@@ -35,15 +37,52 @@ type rtConfig struct {
 }
 
 type cacheConfig struct {
+	// Backend of the cache: bolt, json or memory. bolt if empty.
+	Backend string `json:",omitempty"`
+	// File of the bolt and json backends.
 	File string
+	// Namespace of the keys of cache entries, optional.
+	Namespace string `json:",omitempty"`
+	// Audit retention of the decisions recorded per event.
+	Audit auditConfig
+	// GC removes stale entries.
+	GC gcConfig
+	// Backup writes snapshots of the cache while icinga2rt is running.
+	Backup backupConfig
 }
 
 type ticketConfig struct {
-	Mappings     string
+	Mappings string
+	// Rules is a JSON or YAML file with rules, which are evaluated before the mappings.
+	Rules        string
 	mappings     []mapping
 	Nobody       string
 	Queue        string
 	ClosedStatus []string
+	Routing      []routingRule
+	HostFolding  string
+	Grouping     string
+	CreateDelay  string
+	createDelay  time.Duration
+	Storm        stormConfig
+	// ResolvedStatus is set by the resolve action.
+	ResolvedStatus string
+	// OpenStatus is set by the reopen action.
+	OpenStatus string
+	// ReopenWindow is the duration after resolving a ticket in which the reopen action reopens it.
+	ReopenWindow string
+	reopenWindow time.Duration
+	// Notifications are the handlings of notification types, like ACKNOWLEDGEMENT, by type.
+	Notifications map[string]notificationHandling
+	Users         usersConfig
+	// Schedules by name, used to select mappings by time.
+	Schedules map[string]scheduleConfig
+	schedules []*schedule
+	// MappingSets are applied while their schedule is selected, before Rules and Mappings.
+	MappingSets []mappingSet
+	Escalation  escalationConfig
+	// SLA policies setting the Starts and Due dates of new tickets, the first matching policy is applied.
+	SLA []slaPolicy
 }
 
 type config struct {
@@ -84,6 +123,16 @@ var defaultConfig = config{
 			"resolved",
 			"deleted",
 		},
+		ResolvedStatus: "resolved",
+		OpenStatus:     "open",
+		ReopenWindow:   "24h",
+		Notifications: map[string]notificationHandling{
+			"ACKNOWLEDGEMENT": {Action: "comment"},
+			"DOWNTIMESTART":   {Action: "comment", Status: "stalled"},
+			"DOWNTIMEEND":     {Action: "comment", Status: "open"},
+			"FLAPPINGSTART":   {Action: "comment"},
+			"FLAPPINGEND":     {Action: "comment"},
+		},
 	},
 }
 
@@ -112,16 +161,93 @@ func checkConfig(conf *config) error {
 		return fmt.Errorf("Ticket.Nobody must be set.")
 	}
 
-	if conf.Ticket.Mappings == "" || len(conf.Ticket.Mappings) == 0 {
-		return fmt.Errorf("Ticket.Mappings must be set.")
+	if conf.Ticket.Mappings == "" && conf.Ticket.Rules == "" {
+		return fmt.Errorf("Ticket.Mappings or Ticket.Rules must be set.")
+	}
+
+	for i, v := range conf.Ticket.MappingSets {
+		if !knownSchedule(conf.Ticket.Schedules, strings.TrimPrefix(v.Schedule, ruleNegation)) {
+			return fmt.Errorf("Ticket.MappingSets: unknown schedule %v in mapping set %v", v.Schedule, i)
+		}
+
+		if v.Mappings == "" && v.Rules == "" {
+			return fmt.Errorf("Ticket.MappingSets: Mappings or Rules must be set in mapping set %v", i)
+		}
+	}
+
+	for _, v := range conf.Ticket.mappings {
+		// rules chaining actions are named by all of them.
+		for _, action := range strings.Split(v.name, "+") {
+			if action == actionStringDelayedCreate && conf.Ticket.createDelay <= 0 {
+				return fmt.Errorf("Ticket.CreateDelay must be > 0 if the %v action is used.", actionStringDelayedCreate)
+			}
+		}
+	}
+
+	if err := checkMappingSchedules(conf.Ticket.mappings, conf.Ticket.Schedules); err != nil {
+		return fmt.Errorf("Ticket: %v", err)
 	}
 
 	if conf.Ticket.ClosedStatus == nil || len(conf.Ticket.ClosedStatus) == 0 {
 		return fmt.Errorf("Ticket.ClosedStatus must be set.")
 	}
 
-	if conf.Cache.File == "" {
-		return fmt.Errorf("Cache.File must be set.")
+	switch conf.Cache.Backend {
+	case "", backendBolt, backendJSON:
+		if conf.Cache.File == "" {
+			return fmt.Errorf("Cache.File must be set.")
+		}
+	case backendMemory:
+	default:
+		return fmt.Errorf("Cache.Backend: unknown backend %v", conf.Cache.Backend)
+	}
+
+	if conf.Cache.GC.interval > 0 && conf.Cache.GC.ttl <= 0 {
+		return fmt.Errorf("Cache.GC.TTL must be > 0 if Cache.GC.Interval is set.")
+	}
+
+	if conf.Cache.Backup.Keep < 0 {
+		return fmt.Errorf("Cache.Backup.Keep must not be negative.")
+	}
+
+	if err := checkRouting(conf.Ticket.Routing); err != nil {
+		return fmt.Errorf("Ticket.Routing: %v", err)
+	}
+
+	if err := checkHostFolding(conf.Ticket.HostFolding); err != nil {
+		return fmt.Errorf("Ticket.HostFolding: %v", err)
+	}
+
+	if err := checkGrouping(conf.Ticket.Grouping); err != nil {
+		return fmt.Errorf("Ticket.Grouping: %v", err)
+	}
+
+	if conf.Ticket.HostFolding != "" && conf.Ticket.Grouping != "" {
+		return fmt.Errorf("Only Ticket.HostFolding or Ticket.Grouping can be set")
+	}
+
+	if err := checkNotifications(conf.Ticket.Notifications); err != nil {
+		return fmt.Errorf("Ticket.Notifications: %v", err)
+	}
+
+	if err := checkUsers(conf.Ticket.Users); err != nil {
+		return fmt.Errorf("Ticket.Users: %v", err)
+	}
+
+	if err := checkSLA(conf.Ticket.SLA); err != nil {
+		return fmt.Errorf("Ticket.SLA: %v", err)
+	}
+
+	if err := checkEscalation(conf.Ticket.Escalation); err != nil {
+		return fmt.Errorf("Ticket.Escalation: %v", err)
+	}
+
+	if conf.Ticket.Storm.Threshold < 0 {
+		return fmt.Errorf("Ticket.Storm.Threshold must be >= 0.")
+	}
+
+	if conf.Ticket.Storm.Threshold > 0 && conf.Ticket.Storm.window <= 0 {
+		return fmt.Errorf("Ticket.Storm.Window must be set if Ticket.Storm.Threshold is set.")
 	}
 
 	return nil
@@ -146,17 +272,128 @@ func readConfig(r io.Reader) (*config, error) {
 		return nil, err
 	}
 
-	f, err := os.Open(c.Ticket.Mappings)
-	if err != nil {
-		return nil, err
+	for name, v := range c.Ticket.Schedules {
+		s, err := newSchedule(name, v)
+		if err != nil {
+			return nil, fmt.Errorf("Ticket.Schedules.%v: %v", name, err)
+		}
+
+		c.Ticket.schedules = append(c.Ticket.schedules, s)
 	}
 
-	mappings, err := readMappings(f)
-	if err != nil {
-		return nil, err
+	for i := range c.Ticket.SLA {
+		p := &c.Ticket.SLA[i]
+
+		if p.Response != "" {
+			p.response, err = time.ParseDuration(p.Response)
+			if err != nil {
+				return nil, fmt.Errorf("Ticket.SLA: policy %v: Response: %v", i, err)
+			}
+		}
+
+		if p.Schedule != "" {
+			for _, s := range c.Ticket.schedules {
+				if s.name == p.Schedule {
+					p.schedule = s
+				}
+			}
+
+			if p.schedule == nil {
+				return nil, fmt.Errorf("Ticket.SLA: policy %v: unknown schedule %v", i, p.Schedule)
+			}
+		}
+	}
+
+	for i, v := range c.Ticket.MappingSets {
+		mappings, err := loadMappingSet(v)
+		if err != nil {
+			return nil, fmt.Errorf("Ticket.MappingSets: mapping set %v: %v", i, err)
+		}
+
+		c.Ticket.mappings = append(c.Ticket.mappings, mappings...)
 	}
 
-	c.Ticket.mappings = mappings
+	if c.Ticket.Rules != "" {
+		rules, err := loadRules(c.Ticket.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("Ticket.Rules: %v", err)
+		}
+
+		c.Ticket.mappings = append(c.Ticket.mappings, rules...)
+	}
+
+	if c.Ticket.Mappings != "" {
+		f, err := os.Open(c.Ticket.Mappings)
+		if err != nil {
+			return nil, err
+		}
+
+		mappings, err := readMappings(f)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Ticket.mappings = append(c.Ticket.mappings, withSource(mappings, c.Ticket.Mappings)...)
+	}
+
+	if c.Cache.Audit.MaxAge != "" {
+		c.Cache.Audit.maxAge, err = time.ParseDuration(c.Cache.Audit.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("Cache.Audit.MaxAge: %v", err)
+		}
+	}
+
+	if c.Cache.GC.Interval != "" {
+		c.Cache.GC.interval, err = time.ParseDuration(c.Cache.GC.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("Cache.GC.Interval: %v", err)
+		}
+	}
+
+	if c.Cache.GC.TTL != "" {
+		c.Cache.GC.ttl, err = time.ParseDuration(c.Cache.GC.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("Cache.GC.TTL: %v", err)
+		}
+	}
+
+	if c.Ticket.CreateDelay != "" {
+		c.Ticket.createDelay, err = time.ParseDuration(c.Ticket.CreateDelay)
+		if err != nil {
+			return nil, fmt.Errorf("Ticket.CreateDelay: %v", err)
+		}
+	}
+
+	if c.Ticket.ReopenWindow != "" {
+		c.Ticket.reopenWindow, err = time.ParseDuration(c.Ticket.ReopenWindow)
+		if err != nil {
+			return nil, fmt.Errorf("Ticket.ReopenWindow: %v", err)
+		}
+	}
+
+	if c.Ticket.Escalation.Interval != "" {
+		c.Ticket.Escalation.interval, err = time.ParseDuration(c.Ticket.Escalation.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("Ticket.Escalation.Interval: %v", err)
+		}
+	}
+
+	for i := range c.Ticket.Escalation.Steps {
+		step := &c.Ticket.Escalation.Steps[i]
+		if step.After != "" {
+			step.after, err = time.ParseDuration(step.After)
+			if err != nil {
+				return nil, fmt.Errorf("Ticket.Escalation.Steps: step %v: After: %v", i, err)
+			}
+		}
+	}
+
+	if c.Ticket.Storm.Window != "" {
+		c.Ticket.Storm.window, err = time.ParseDuration(c.Ticket.Storm.Window)
+		if err != nil {
+			return nil, fmt.Errorf("Ticket.Storm.Window: %v", err)
+		}
+	}
 
 	return &c, nil
 }
@@ -196,36 +433,136 @@ func parseCSVBool(value string) (bool, error) {
 }
 
 const (
-	actionStringDelete  = "delete"
-	actionStringComment = "comment"
-	actionStringCreate  = "create"
-	actionStringIgnore  = "ignore"
+	actionStringDelete        = "delete"
+	actionStringComment       = "comment"
+	actionStringCreate        = "create"
+	actionStringDelayedCreate = "delayedcreate"
+	actionStringIgnore        = "ignore"
+	actionStringResolve       = "resolve"
+	actionStringReopen        = "reopen"
+	// actions with a parameter, separated by a colon, e.g. setstatus:stalled
+	actionStringSetStatus   = "setstatus"
+	actionStringSetPriority = "setpriority"
+	actionStringAssign      = "assign"
 )
 
+// parseCSVActions parses a single action or a chain of actions separated by "+", e.g. comment+resolve.
+func parseCSVActions(value string) (actionFunc, error) {
+	names := strings.Split(value, "+")
+	if len(names) == 1 {
+		return parseCSVAction(value)
+	}
+
+	actions := make([]actionFunc, 0, len(names))
+	for _, v := range names {
+		action, err := parseCSVAction(v)
+		if err != nil {
+			return nil, err
+		}
+
+		actions = append(actions, action)
+	}
+
+	return actionChain(names, actions), nil
+}
+
 func parseCSVAction(value string) (actionFunc, error) {
-	switch strings.ToLower(value) {
+	// only the name of the action is case-insensitive, parameters like user names aren't.
+	name, param := value, ""
+	if i := strings.Index(value, ":"); i != -1 {
+		name, param = value[:i], value[i+1:]
+	}
+
+	action, err := newAction(name, param)
+	if err != nil {
+		return nil, fmt.Errorf("%v in action value: %v", err, value)
+	}
+
+	return action, nil
+}
+
+// newAction returns the action with the name, using param for actions with a parameter.
+func newAction(name string, param string) (actionFunc, error) {
+	switch strings.ToLower(name) {
+	case actionStringSetStatus:
+		if param == "" {
+			return nil, fmt.Errorf("missing status")
+		}
+		return func(t *ticketUpdater, e *event.Notification) error { return t.setStatus(e, param) }, nil
+	case actionStringSetPriority:
+		if _, err := strconv.Atoi(param); err != nil {
+			return nil, fmt.Errorf("invalid priority")
+		}
+		return func(t *ticketUpdater, e *event.Notification) error { return t.setPriority(e, param) }, nil
+	case actionStringAssign:
+		if param == "" {
+			return nil, fmt.Errorf("missing user")
+		}
+		return func(t *ticketUpdater, e *event.Notification) error { return t.assign(e, param) }, nil
+	}
+
+	if param != "" {
+		return nil, fmt.Errorf("unexpected parameter")
+	}
+
+	switch strings.ToLower(name) {
 	case actionStringDelete:
 		return (*ticketUpdater).delete, nil
 	case actionStringComment:
 		return (*ticketUpdater).comment, nil
 	case actionStringCreate:
 		return (*ticketUpdater).create, nil
+	case actionStringDelayedCreate:
+		return (*ticketUpdater).delayedCreate, nil
 	case actionStringIgnore:
 		return (*ticketUpdater).ignore, nil
+	case actionStringResolve:
+		return (*ticketUpdater).resolve, nil
+	case actionStringReopen:
+		return (*ticketUpdater).reopen, nil
 	default:
-		return nil, fmt.Errorf("invalid action value: %v", value)
+		return nil, fmt.Errorf("invalid action")
+	}
+}
+
+// parseCSVValue parses a single value of a condition using normalize, or the wildcard.
+func parseCSVValue(value string, normalize func(string) (string, error)) (values, error) {
+	if value == wildcard {
+		return anyValue, nil
+	}
+
+	x, err := normalize(value)
+	if err != nil {
+		return anyValue, err
+	}
+
+	return oneValue(x), nil
+}
+
+// withSource prefixes the sources of the mappings with the name of the file they were read from.
+func withSource(ms []mapping, filename string) []mapping {
+	for i := range ms {
+		ms[i].source = fmt.Sprintf("%v %v", filename, ms[i].source)
 	}
 
+	return ms
 }
 
+// readMappings reads mappings from CSV with either 4 columns:
+//
+//	state, old state, owned, action
+//
+// or 8 columns:
+//
+//	state, old state, owned, notification type, object type, ticket status, queue, action
 func readMappings(r io.Reader) ([]mapping, error) {
 	ms := []mapping{}
 
 	x := csv.NewReader(r)
 	x.Comment = '#'
 
-	// state, old state, existing, owned, action
-	x.FieldsPerRecord = 4
+	// the number of fields is checked below.
+	x.FieldsPerRecord = -1
 	line := 0
 	for {
 		line++
@@ -238,25 +575,55 @@ func readMappings(r io.Reader) ([]mapping, error) {
 			break
 		}
 
-		// uppercase the value as icingas strings are uppercase
-		state := event.NewState(strings.ToUpper(record[0]))
-		if state == event.StateNil {
-			return nil, fmt.Errorf("error in line %v: invalid state value %v", line, record[0])
+		if len(record) != 4 && len(record) != 8 {
+			return nil, fmt.Errorf("error in line %v: wrong number of fields: %v, expected 4 or 8", line, len(record))
+		}
+
+		c := condition{}
+
+		c.state, err = parseCSVValue(record[0], normalizeState)
+		if err != nil {
+			return nil, fmt.Errorf("error in line %v: %v", line, err)
 		}
 
-		oldState := event.NewState(record[1])
+		c.oldState, err = parseCSVValue(record[1], normalizeOldState)
+		if err != nil {
+			return nil, fmt.Errorf("error in line %v: %v", line, err)
+		}
 
-		owned, err := parseCSVBool(record[2])
+		c.owned, err = parseCSVValue(record[2], normalizeOwned)
 		if err != nil {
 			return nil, fmt.Errorf("error in line %v: %v", line, err)
 		}
 
-		action, err := parseCSVAction(record[3])
+		if len(record) == 8 {
+			c.notificationType, err = parseCSVValue(record[3], normalizeNotificationType)
+			if err != nil {
+				return nil, fmt.Errorf("error in line %v: %v", line, err)
+			}
+
+			c.objectType, err = parseCSVValue(record[4], normalizeObjectType)
+			if err != nil {
+				return nil, fmt.Errorf("error in line %v: %v", line, err)
+			}
+
+			c.ticketStatus, err = parseCSVValue(record[5], normalizeString)
+			if err != nil {
+				return nil, fmt.Errorf("error in line %v: %v", line, err)
+			}
+
+			c.queue, err = parseCSVValue(record[6], normalizeString)
+			if err != nil {
+				return nil, fmt.Errorf("error in line %v: %v", line, err)
+			}
+		}
+
+		action, err := parseCSVActions(record[len(record)-1])
 		if err != nil {
 			return nil, fmt.Errorf("error in line %v: %v", line, err)
 		}
 
-		m := mapping{condition: condition{state: state, oldState: oldState, owned: owned}, action: action}
+		m := mapping{condition: c, action: action, name: record[len(record)-1], source: fmt.Sprintf("line %v", line)}
 		ms = append(ms, m)
 	}
 
@@ -38,3 +38,56 @@ func TestReadMappings(t *testing.T) {
 		}
 	}
 }
+
+func TestParseCSVAction(t *testing.T) {
+	for _, v := range []string{"create", "DelayedCreate", "resolve", "reopen", "setstatus:stalled", "SetPriority:90", "assign:JohnDoe"} {
+		if _, err := parseCSVAction(v); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, v := range []string{"create:now", "setstatus", "setstatus:", "setpriority:high", "assign:", "close"} {
+		if _, err := parseCSVAction(v); err == nil {
+			t.Errorf("expected error while parsing invalid action: %v", v)
+		}
+	}
+
+	if _, err := parseCSVActions("comment+setstatus:stalled+assign:JohnDoe"); err != nil {
+		t.Error(err)
+	}
+
+	for _, v := range []string{"comment+", "comment+close", "+resolve"} {
+		if _, err := parseCSVActions(v); err == nil {
+			t.Errorf("expected error while parsing invalid action chain: %v", v)
+		}
+	}
+}
+
+const validExtendedCSV = `# state, old state, owned, notification type, object type, ticket status, queue, action
+OK,WARNING,true,*,*,*,*,comment
+*,*,*,ACKNOWLEDGEMENT,service,open,general,comment
+CRITICAL,,false,problem,Host,*,*,create
+OK,CRITICAL,*,*,*,stalled,*,ignore`
+
+const invalidCSVFields = `OK,WARNING,true,*,comment`
+const invalidCSVOldState = `OK,BROKEN,true,comment`
+const invalidCSVNotificationType = `OK,WARNING,true,BROKEN,*,*,*,comment`
+const invalidCSVObjectType = `OK,WARNING,true,*,hostgroup,*,*,comment`
+
+func TestReadExtendedMappings(t *testing.T) {
+	ms, err := readMappings(strings.NewReader(validExtendedCSV + "\n" + validCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ms) != 8 {
+		t.Errorf("expected 8 mappings, got %v", len(ms))
+	}
+
+	for _, v := range []string{invalidCSVFields, invalidCSVOldState, invalidCSVNotificationType, invalidCSVObjectType} {
+		_, err := readMappings(strings.NewReader(v))
+		if err == nil {
+			t.Errorf("expected error while parsing invalid CSV: %v", v)
+		}
+	}
+}
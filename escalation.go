@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+// defaultEscalationInterval is used if no interval is configured.
+const defaultEscalationInterval = time.Minute
+
+// escalationStep changes unowned tickets which are open for longer than After. Empty properties aren't changed.
+type escalationStep struct {
+	// After is the duration since the creation of the ticket, like "4h".
+	After string
+	after time.Duration
+	// States the event must have, an empty list matches every state.
+	States   []string `json:",omitempty"`
+	Priority string   `json:",omitempty"`
+	Queue    string   `json:",omitempty"`
+	// AdminCc are added to the AdminCc of the ticket.
+	AdminCc []string `json:",omitempty"`
+	Comment string   `json:",omitempty"`
+}
+
+type escalationConfig struct {
+	// Interval of scans for tickets to escalate, like "5m". One minute if empty.
+	Interval string
+	interval time.Duration
+	// Steps are applied once per ticket each, in order.
+	Steps []escalationStep
+}
+
+// checkEscalation validates the states used in escalation steps.
+func checkEscalation(c escalationConfig) error {
+	for i, v := range c.Steps {
+		if v.after <= 0 {
+			return fmt.Errorf("After must be set in step %v", i)
+		}
+
+		for _, s := range v.States {
+			if _, err := normalizeState(s); err != nil {
+				return fmt.Errorf("%v in step %v", err, i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// escalation applies escalation steps to unowned tickets.
+type escalation struct {
+	steps    []escalationStep
+	interval time.Duration
+	now      func() time.Time
+}
+
+func newEscalation(c escalationConfig) *escalation {
+	interval := c.interval
+	if interval <= 0 {
+		interval = defaultEscalationInterval
+	}
+
+	return &escalation{steps: c.Steps, interval: interval, now: time.Now}
+}
+
+func escalated(et *eventTicket, step int) bool {
+	for _, v := range et.Escalated {
+		if v == step {
+			return true
+		}
+	}
+
+	return false
+}
+
+// match returns true if the step is due for a ticket of age, hostState is empty for service and group events.
+func (s escalationStep) match(state, hostState string, age time.Duration) bool {
+	if age < s.after {
+		return false
+	}
+
+	if len(s.States) == 0 {
+		return true
+	}
+
+	return values{include: s.States}.matchState(state, hostState)
+}
+
+// apply changes the ticket according to the step.
+func (s escalationStep) apply(rtClient rtClient, ticket *rt.Ticket) error {
+	changes := &rt.Ticket{ID: ticket.ID, Priority: s.Priority, Queue: s.Queue}
+
+	if len(s.AdminCc) != 0 {
+		adminCc := s.AdminCc
+		if ticket.AdminCc != "" {
+			adminCc = append([]string{ticket.AdminCc}, adminCc...)
+		}
+		changes.AdminCc = strings.Join(adminCc, ", ")
+	}
+
+	if changes.Priority != "" || changes.Queue != "" || changes.AdminCc != "" {
+		if _, err := rtClient.UpdateTicket(changes); err != nil {
+			return err
+		}
+
+		// keep the ticket current for further steps.
+		if changes.AdminCc != "" {
+			ticket.AdminCc = changes.AdminCc
+		}
+	}
+
+	if s.Comment != "" {
+		if err := rtClient.CommentTicket(ticket.ID, s.Comment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// escalate applies due escalation steps to all unowned, open tickets in the cache. t.mu must not be held.
+func (t *ticketUpdater) escalate() error {
+	ets, err := t.cache.allEntries()
+	if err != nil {
+		return err
+	}
+
+	now := t.escalation.now()
+
+	for _, et := range ets {
+		if err := t.escalateEvent(et.Event, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// escalateEvent applies the due escalation steps to the entry of the event. t.mu is only held for a single entry,
+// which is read again under the lock, so events aren't blocked for the whole scan.
+func (t *ticketUpdater) escalateEvent(e *event.Notification, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	et, err := t.cache.getEntry(e)
+	if err != nil {
+		return err
+	}
+
+	// folded events are tracked on the ticket of their host, which has an entry too.
+	if et == nil || et.TicketID == -1 || et.Folded || !et.Resolved.IsZero() {
+		return nil
+	}
+
+	// entries saved by older versions are escalated from now on.
+	if et.Created.IsZero() {
+		et.Created = now
+		return t.cache.putEntry(et)
+	}
+
+	if err := t.escalateEntry(et, now.Sub(et.Created)); err != nil {
+		log.Printf("%x ticket updater: couldn't escalate ticket #%v: %v", eventID(et.Event), et.TicketID, err)
+	}
+
+	return nil
+}
+
+func (t *ticketUpdater) escalateEntry(et *eventTicket, age time.Duration) error {
+	var ticket *rt.Ticket
+
+	state, host := et.Event.CheckResult.State.String(), hostState(et.Event)
+
+	for i, v := range t.escalation.steps {
+		if escalated(et, i) || !v.match(state, host, age) {
+			continue
+		}
+
+		// the ticket is only fetched if a step is due.
+		if ticket == nil {
+			var err error
+			ticket, err = t.rtClient.Ticket(et.TicketID)
+			if err != nil {
+				return err
+			}
+
+			if t.closed(ticket) || ticket.Owner != t.nobody {
+				return nil
+			}
+		}
+
+		if err := v.apply(t.rtClient, ticket); err != nil {
+			return err
+		}
+
+		log.Printf("%x ticket updater: applied escalation step %v to ticket #%v", eventID(et.Event), i, et.TicketID)
+
+		// record each step, so it isn't repeated if a later step fails.
+		et.Escalated = append(et.Escalated, i)
+		if err := t.cache.putEntry(et); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runEscalation scans for tickets to escalate in the escalation interval, it doesn't return.
+func (t *ticketUpdater) runEscalation() {
+	for range time.Tick(t.escalation.interval) {
+		err := t.escalate()
+
+		if err != nil {
+			log.Printf("ticket updater: escalation failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func TestTicketUpdaterEscalate(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	now := time.Now()
+
+	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+	tu.escalation = newEscalation(escalationConfig{Steps: []escalationStep{
+		{after: time.Hour, Priority: "50", AdminCc: []string{"lead@example.com"}},
+		{after: 2 * time.Hour, States: []string{"CRITICAL"}, Queue: "escalated", AdminCc: []string{"boss@example.com"}, Comment: "Escalated"},
+	}})
+	tu.escalation.now = func() time.Time { return now }
+
+	for _, v := range []*event.Notification{
+		newTestEvent("example.com", "critical", event.StateCritical),
+		newTestEvent("example.com", "warning", event.StateWarning),
+		newTestEvent("example.com", "owned", event.StateCritical),
+	} {
+		if err := tu.update(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rt.tickets[2].Owner = "JohnDoe"
+
+	steps := []struct {
+		After      time.Duration
+		Priorities [3]string
+		Queues     [3]string
+	}{
+		{After: 30 * time.Minute, Priorities: [3]string{"", "", ""}, Queues: [3]string{"Test-Queue", "Test-Queue", "Test-Queue"}},
+		{After: 90 * time.Minute, Priorities: [3]string{"50", "50", ""}, Queues: [3]string{"Test-Queue", "Test-Queue", "Test-Queue"}},
+		{After: 3 * time.Hour, Priorities: [3]string{"50", "50", ""}, Queues: [3]string{"escalated", "Test-Queue", "Test-Queue"}},
+		{After: 4 * time.Hour, Priorities: [3]string{"50", "50", ""}, Queues: [3]string{"escalated", "Test-Queue", "Test-Queue"}},
+	}
+
+	for i, v := range steps {
+		now = time.Now().Add(v.After)
+
+		if err := tu.escalate(); err != nil {
+			t.Fatal(err)
+		}
+
+		for j := range v.Priorities {
+			if rt.tickets[j].Priority != v.Priorities[j] || rt.tickets[j].Queue != v.Queues[j] {
+				t.Errorf("step %v: unexpected ticket %v: %+v", i, j, rt.tickets[j])
+			}
+		}
+	}
+
+	if rt.tickets[0].AdminCc != "lead@example.com, boss@example.com" || rt.tickets[1].AdminCc != "lead@example.com" {
+		t.Errorf("unexpected AdminCc: %v, %v", rt.tickets[0].AdminCc, rt.tickets[1].AdminCc)
+	}
+
+	if len(rt.comments[0]) != 1 {
+		t.Errorf("escalation wasn't commented once: %v", rt.comments[0])
+	}
+
+	et, err := cache.getEntry(newTestEvent("example.com", "critical", event.StateCritical))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(et.Escalated) != 2 {
+		t.Errorf("escalations weren't recorded: %v", et.Escalated)
+	}
+
+	// comments keep the recorded escalations.
+	if err := tu.update(newTestEvent("example.com", "critical", event.StateWarning)); err != nil {
+		t.Fatal(err)
+	}
+
+	et, err = cache.getEntry(newTestEvent("example.com", "critical", event.StateWarning))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(et.Escalated) != 2 || et.Created.IsZero() {
+		t.Errorf("escalations weren't kept: %+v", et)
+	}
+}
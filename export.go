@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Formats of exported entries.
+const (
+	// formatJSONL writes a record per line, like saved in the cache. It's the only format which can be imported.
+	formatJSONL = "jsonl"
+	// formatCSV writes a table of the main fields of the entries, for reading them in other tools.
+	formatCSV = "csv"
+)
+
+// Modes of imports.
+const (
+	// importMerge adds the imported entries, replacing existing entries of the same events.
+	importMerge = "merge"
+	// importReplace removes the entries which aren't imported, the cache only contains the imported entries.
+	importReplace = "replace"
+	// importSkipExisting only adds the entries of events which aren't in the cache yet.
+	importSkipExisting = "skip-existing"
+)
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes all entries as JSONL, returning the number of bytes written.
+func (c *cache) WriteTo(w io.Writer) (int64, error) {
+	return c.export(w, formatJSONL, entryFilter{})
+}
+
+// ReadFrom merges the JSONL entries read from r into the cache, returning the number of bytes read.
+func (c *cache) ReadFrom(r io.Reader) (int64, error) {
+	_, n, err := c.importEntries(r, importOptions{mode: importMerge})
+	return n, err
+}
+
+// export writes the entries matching the filter in the format, returning the number of bytes written.
+func (c *cache) export(w io.Writer, format string, f entryFilter) (int64, error) {
+	ets, err := c.listEntries(f)
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &countWriter{w: w}
+
+	switch format {
+	case formatJSONL:
+		err = writeJSONL(cw, ets)
+	case formatCSV:
+		err = c.writeCSV(cw, ets)
+	default:
+		err = fmt.Errorf("unknown format %v", format)
+	}
+
+	return cw.n, err
+}
+
+func writeJSONL(w io.Writer, ets []*eventTicket) error {
+	enc := json.NewEncoder(w)
+
+	for _, v := range ets {
+		if err := enc.Encode(newTicketRecord(v)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// formatTime formats t as RFC 3339, or empty if it's zero.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (c *cache) writeCSV(w io.Writer, ets []*eventTicket) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{"key", "host", "service", "state", "ticket", "status", "created", "resolved", "lastNotification"}); err != nil {
+		return err
+	}
+
+	for _, v := range ets {
+		r := newEventRecord(v.Event)
+
+		err := cw.Write([]string{
+			string(c.key(v.Event)),
+			r.Host,
+			r.Service,
+			r.State,
+			strconv.Itoa(v.TicketID),
+			v.TicketStatus,
+			formatTime(v.Created),
+			formatTime(v.Resolved),
+			formatTime(r.LastNotification),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// importOptions control how entries are imported.
+type importOptions struct {
+	// mode is one of importMerge, importReplace or importSkipExisting.
+	mode string
+	// rt is used to check that the tickets of the imported entries exist, entries of other tickets are conflicts.
+	// Tickets aren't checked if nil.
+	rt rtClient
+	// dryRun only reports the changes of the import, nothing is written.
+	dryRun bool
+}
+
+// importConflict is an imported entry which isn't written.
+type importConflict struct {
+	key    string
+	reason string
+}
+
+// importReport lists the changes of an import by the keys of the entries.
+type importReport struct {
+	added     []string
+	changed   []string
+	removed   []string
+	unchanged int
+	conflicts []importConflict
+}
+
+// readImport reads the JSONL entries from r. Lines of older versions, which wrote entries without record version,
+// are read too.
+func readImport(r io.Reader) ([]*eventTicket, error) {
+	ets := []*eventTicket{}
+	dec := json.NewDecoder(r)
+
+	for i := 1; ; i++ {
+		var x json.RawMessage
+		if err := dec.Decode(&x); err != nil {
+			if err == io.EOF {
+				return ets, nil
+			}
+			return nil, fmt.Errorf("record %v: %v", i, err)
+		}
+
+		var version struct {
+			Version int `json:"version"`
+		}
+		if err := json.Unmarshal(x, &version); err != nil {
+			return nil, fmt.Errorf("record %v: %v", i, err)
+		}
+
+		// every record gets its own entry, they are kept until all are written.
+		var et *eventTicket
+		var err error
+		if version.Version == 0 {
+			et = &eventTicket{}
+			err = json.Unmarshal(x, et)
+		} else {
+			et, err = unmarshalTicketRecord(x)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %v: %v", i, err)
+		}
+
+		if et.Event == nil || et.Event.Host == "" {
+			return nil, fmt.Errorf("record %v: no host", i)
+		}
+
+		ets = append(ets, et)
+	}
+}
+
+// importEntries reads JSONL entries from r and writes them to the cache like set in opts, returning a report of
+// the changes and the number of bytes read. Nothing is written if the entries can't be read.
+func (c *cache) importEntries(r io.Reader, opts importOptions) (*importReport, int64, error) {
+	switch opts.mode {
+	case importMerge, importReplace, importSkipExisting:
+	default:
+		return nil, 0, fmt.Errorf("unknown import mode %v", opts.mode)
+	}
+
+	cr := &countReader{r: r}
+
+	ets, err := readImport(cr)
+	if err != nil {
+		return nil, cr.n, err
+	}
+
+	report := &importReport{}
+
+	// check the tickets before the transaction, RT is slow.
+	missing := make(map[int]error)
+	if opts.rt != nil {
+		for _, v := range ets {
+			if _, ok := missing[v.TicketID]; ok || v.TicketID == -1 {
+				continue
+			}
+
+			_, err := opts.rt.Ticket(v.TicketID)
+			missing[v.TicketID] = err
+		}
+	}
+
+	apply := func(tx StoreTx) error {
+		imported := make(map[string]bool, len(ets))
+
+		for _, v := range ets {
+			key := c.key(v.Event)
+
+			if imported[string(key)] {
+				report.conflicts = append(report.conflicts, importConflict{key: string(key), reason: "imported twice, the first entry is used"})
+				continue
+			}
+
+			if err := missing[v.TicketID]; err != nil {
+				report.conflicts = append(report.conflicts, importConflict{key: string(key), reason: fmt.Sprintf("ticket #%v: %v", v.TicketID, err)})
+				continue
+			}
+
+			imported[string(key)] = true
+
+			x, err := marshalTicketRecord(v)
+			if err != nil {
+				return err
+			}
+
+			switch old := tx.Get(eventBucketName, key); {
+			case old == nil:
+				report.added = append(report.added, string(key))
+			case sameRecord(old, x):
+				report.unchanged++
+				continue
+			case opts.mode == importSkipExisting:
+				report.conflicts = append(report.conflicts, importConflict{key: string(key), reason: "exists with other values"})
+				continue
+			default:
+				report.changed = append(report.changed, string(key))
+			}
+
+			if opts.dryRun {
+				continue
+			}
+
+			if err := c.putEntryTx(tx, v); err != nil {
+				return err
+			}
+		}
+
+		if opts.mode != importReplace {
+			return nil
+		}
+
+		// collect the keys first, the bucket can't be changed in ForEach.
+		err := tx.ForEach(eventBucketName, nil, func(k, v []byte) error {
+			if !imported[string(k)] {
+				report.removed = append(report.removed, string(k))
+			}
+			return nil
+		})
+		if err != nil || opts.dryRun {
+			return err
+		}
+
+		for _, v := range report.removed {
+			if err := deleteEntryTx(tx, []byte(v)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if opts.dryRun {
+		err = c.Store.View(apply)
+	} else {
+		err = c.Store.Update(apply)
+	}
+
+	return report, cr.n, err
+}
+
+// sameRecord returns true if the saved entry old has the record x.
+func sameRecord(old []byte, x []byte) bool {
+	et, err := decodeEventTicket(old)
+	if err != nil {
+		return false
+	}
+
+	y, err := marshalTicketRecord(et)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(x, y)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+// putTestEntries saves an entry with the ticket for every host and service.
+func putTestEntries(t *testing.T, c *cache, entries map[string]int) {
+	for k, v := range entries {
+		parts := strings.SplitN(k, "/", 2)
+		e := newTestEvent(parts[0], "", event.StateCritical)
+		if len(parts) == 2 {
+			e.Service = parts[1]
+		}
+
+		if err := c.putEntry(&eventTicket{Event: e, TicketID: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCacheExport(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	putTestEntries(t, cache, map[string]int{"example.com/http": 1, "example.com/ssh": 2, "example.org": 3})
+
+	var buf bytes.Buffer
+	n, err := cache.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(buf.Len()) || strings.Count(buf.String(), "\n") != 3 {
+		t.Errorf("expected 3 lines of %v bytes, got %v:\n%v", buf.Len(), n, buf.String())
+	}
+
+	buf.Reset()
+	n, err = cache.export(&buf, formatCSV, entryFilter{host: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(buf.Len()) {
+		t.Errorf("expected %v bytes, got %v", buf.Len(), n)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 3 || !reflect.DeepEqual(records[1][:5], []string{"service/example.com/http", "example.com", "http", "CRITICAL", "1"}) {
+		t.Errorf("unexpected csv: %v", records)
+	}
+
+	if _, err := cache.export(&buf, "xml", entryFilter{}); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestCacheImport(t *testing.T) {
+	source, sourcePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(source, sourcePath)
+
+	putTestEntries(t, source, map[string]int{"example.com/http": 1, "example.com/ssh": 5, "example.org": 3})
+
+	var export bytes.Buffer
+	if _, err := source.WriteTo(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	// tickets #0 to #3 exist.
+	dummy := NewDummyRT()
+	for i := 0; i < 4; i++ {
+		if _, err := dummy.NewTicket(&rt.Ticket{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		opts      importOptions
+		added     int
+		changed   int
+		removed   int
+		conflicts int
+		entries   int
+	}{
+		{opts: importOptions{mode: importMerge, dryRun: true}, added: 2, changed: 1, entries: 2},
+		{opts: importOptions{mode: importMerge}, added: 2, changed: 1, entries: 4},
+		{opts: importOptions{mode: importSkipExisting}, added: 2, conflicts: 1, entries: 4},
+		{opts: importOptions{mode: importReplace}, added: 2, changed: 1, removed: 1, entries: 3},
+		{opts: importOptions{mode: importMerge, rt: dummy}, added: 1, changed: 1, conflicts: 1, entries: 3},
+	}
+
+	for i, v := range tests {
+		cache, cachePath, err := tempCache()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		putTestEntries(t, cache, map[string]int{"example.com/http": 2, "example.net": 4})
+
+		report, n, err := cache.importEntries(bytes.NewReader(export.Bytes()), v.opts)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+
+		if n != int64(export.Len()) {
+			t.Errorf("%v: expected %v bytes read, got %v", i, export.Len(), n)
+		}
+
+		if len(report.added) != v.added || len(report.changed) != v.changed || len(report.removed) != v.removed || len(report.conflicts) != v.conflicts {
+			t.Errorf("%v: unexpected report %+v", i, report)
+		}
+
+		ets, err := cache.allEntries()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ets) != v.entries {
+			t.Errorf("%v: expected %v entries, got %v", i, v.entries, len(ets))
+		}
+
+		removeCache(cache, cachePath)
+	}
+}
+
+func TestCacheImportLegacy(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	// written by older versions, which encoded the entries directly.
+	legacy := `{"Event":{"host":"example.com","service":"http","check_result":{"state":2}},"TicketID":7}
+{"Event":{"host":"example.com","service":"ssh","check_result":{"state":1}},"TicketID":8}
+`
+
+	if _, err := cache.ReadFrom(strings.NewReader(legacy)); err != nil {
+		t.Fatal(err)
+	}
+
+	et, err := cache.getEntry(&event.Notification{Host: "example.com", Service: "ssh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every record has its own entry.
+	if et == nil || et.TicketID != 8 || et.Event.Service != "ssh" {
+		t.Errorf("unexpected entry %+v", et)
+	}
+
+	if _, err := cache.ReadFrom(strings.NewReader(`{"TicketID":9}`)); err == nil {
+		t.Error("expected error for entry without host")
+	}
+}
+
+func TestCacheImportCommand(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	putTestEntries(t, cache, map[string]int{"example.com/http": 1})
+
+	var export, out bytes.Buffer
+	env := &commandEnv{cache: cache, in: &export, out: &export}
+
+	if err := runCommand(env, []string{"cache", "export", "-host", "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	env.out = &out
+	if err := runCommand(env, []string{"cache", "import", "-mode", "skip-existing", "-dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if x := out.String(); !strings.Contains(x, "0 added, 0 changed, 0 removed, 1 unchanged, 0 conflicts, dry run") {
+		t.Errorf("unexpected report:\n%v", x)
+	}
+
+	if err := runCommand(env, []string{"cache", "import", "-mode", "overwrite"}); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+// Host folding modes. Service events of a host with an open ticket are
+// either added as comment to the host ticket or suppressed.
+const (
+	hostFoldingComment  = "comment"
+	hostFoldingSuppress = "suppress"
+)
+
+func checkHostFolding(mode string) error {
+	switch mode {
+	case "", hostFoldingComment, hostFoldingSuppress:
+		return nil
+	default:
+		return fmt.Errorf("invalid host folding mode: %v", mode)
+	}
+}
+
+// hostEvent returns the host-level event for the host of e, which is an event without service.
+func hostEvent(e *event.Notification) *event.Notification {
+	return &event.Notification{Host: e.Host}
+}
+
+// hostTicket returns the id of an open ticket for the host of e, or -1 if there is none.
+func (t *ticketUpdater) hostTicket(e *event.Notification) (int, error) {
+	h := hostEvent(e)
+
+	oldEvent, ticketID, err := t.cache.getEventTicket(h)
+	if err != nil {
+		return -1, err
+	}
+
+	if oldEvent == nil || ticketID == -1 || !t.openTicket(ticketID) {
+		return -1, nil
+	}
+
+	return ticketID, nil
+}
+
+func formatFoldComment(e *event.Notification) string {
+	if e.CheckResult.Output != "" {
+		return fmt.Sprintf("%v Output: %v", formatEventSubject(e), e.CheckResult.Output)
+	}
+
+	return formatEventSubject(e)
+}
+
+// fold handles service events of hosts with an open ticket. Problems of such services don't get an own ticket,
+// instead they are tracked as folded entries referencing the host ticket until they recover.
+//
+// It returns true if the event was handled and must not be processed by the mappings.
+func (t *ticketUpdater) fold(e *event.Notification) (bool, error) {
+	entry, err := t.cache.getEntry(e)
+	if err != nil {
+		return false, err
+	}
+
+	// the service has an own ticket, so it isn't folded.
+	if entry != nil && !entry.Folded {
+		return false, nil
+	}
+
+	hostTicketID, err := t.hostTicket(e)
+	if err != nil {
+		return false, err
+	}
+
+	if hostTicketID == -1 {
+		// the host ticket is gone, so the service is handled on its own again.
+		if entry != nil {
+			if *debug {
+				log.Printf("%x ticket updater: host ticket of folded event is gone", eventID(e))
+			}
+			if err := t.cache.deleteEventTicket(e); err != nil {
+				return false, err
+			}
+		}
+
+		return false, nil
+	}
+
+	recovered := e.CheckResult.State == event.StateOK
+
+	switch {
+	case entry == nil && recovered:
+		// nothing was folded, let the mappings decide.
+		return false, nil
+	case entry != nil && !recovered && entry.Event.CheckResult.State == e.CheckResult.State:
+		// state hasn't changed, nothing to tell.
+	case t.hostFolding == hostFoldingComment:
+		if err := t.rtClient.CommentTicket(hostTicketID, formatFoldComment(e)); err != nil {
+			return false, err
+		}
+
+		if *debug {
+			log.Printf("%x ticket updater: commented host ticket #%v", eventID(e), hostTicketID)
+		}
+	}
+
+	if recovered {
+		if *debug {
+			log.Printf("%x ticket updater: folded event recovered", eventID(e))
+		}
+		return true, t.cache.deleteEventTicket(e)
+	}
+
+	if *debug {
+		log.Printf("%x ticket updater: folded event into host ticket #%v", eventID(e), hostTicketID)
+	}
+
+	return true, t.cache.putEntry(&eventTicket{Event: e, TicketID: hostTicketID, Folded: true})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func newTestEvent(host, service string, state event.State) *event.Notification {
+	return &event.Notification{Host: host, Service: service, CheckResult: event.CheckResultData{State: state, VarsAfter: event.CheckResultVars{Reachable: true}}}
+}
+
+func TestTicketUpdaterFold(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+	tu.hostFolding = hostFoldingComment
+
+	steps := []struct {
+		Event    *event.Notification
+		Tickets  int  // number of tickets created after processing
+		Comments int  // number of comments on the host ticket after processing
+		Folded   bool // service entry is folded after processing
+	}{
+		{Event: newTestEvent("example.com", "", event.StateCritical), Tickets: 1, Comments: 0},
+		{Event: newTestEvent("example.com", "http", event.StateCritical), Tickets: 1, Comments: 1, Folded: true},
+		{Event: newTestEvent("example.com", "http", event.StateCritical), Tickets: 1, Comments: 1, Folded: true},
+		{Event: newTestEvent("example.com", "http", event.StateWarning), Tickets: 1, Comments: 2, Folded: true},
+		{Event: newTestEvent("example.com", "http", event.StateOK), Tickets: 1, Comments: 3},
+		{Event: newTestEvent("example.com", "ssh", event.StateCritical), Tickets: 1, Comments: 4, Folded: true},
+		// host recovers, the ticket is deleted and the folded service gets an own ticket.
+		{Event: newTestEvent("example.com", "", event.StateOK), Tickets: 1, Comments: 4},
+		{Event: newTestEvent("example.com", "ssh", event.StateCritical), Tickets: 2, Comments: 4},
+	}
+
+	for i, v := range steps {
+		if err := tu.update(v.Event); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rt.tickets) != v.Tickets {
+			t.Errorf("step %v: got %v tickets, expected %v", i, len(rt.tickets), v.Tickets)
+		}
+
+		if len(rt.comments[0]) != v.Comments {
+			t.Errorf("step %v: got %v comments, expected %v", i, len(rt.comments[0]), v.Comments)
+		}
+
+		if v.Event.Service == "" {
+			continue
+		}
+
+		entry, err := cache.getEntry(v.Event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		folded := entry != nil && entry.Folded
+		if folded != v.Folded {
+			t.Errorf("step %v: folded: %v expected: %v", i, folded, v.Folded)
+		}
+	}
+}
+
+func TestTicketUpdaterFoldSuppress(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+	tu.hostFolding = hostFoldingSuppress
+
+	for _, v := range []*event.Notification{
+		newTestEvent("example.com", "", event.StateCritical),
+		newTestEvent("example.com", "http", event.StateCritical),
+		newTestEvent("example.com", "http", event.StateOK),
+	} {
+		if err := tu.update(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(rt.tickets) != 1 || len(rt.comments[0]) != 0 {
+		t.Errorf("got %v tickets and %v comments, expected 1 ticket without comments", len(rt.tickets), len(rt.comments[0]))
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bytemine/icinga2rt/objects"
+)
+
+type gcConfig struct {
+	// Interval of garbage collections, like "1h". Disabled if empty.
+	Interval string `json:",omitempty"`
+	interval time.Duration
+	// TTL is the idle time of entries with closed tickets before they are removed, like "168h". Must be set.
+	TTL string `json:",omitempty"`
+	ttl time.Duration
+	// Objects removes entries whose host or service doesn't exist in Icinga anymore.
+	Objects bool `json:",omitempty"`
+	// DryRun only logs the entries which would be removed.
+	DryRun bool `json:",omitempty"`
+}
+
+// gc removes stale entries from the cache.
+type gc struct {
+	interval time.Duration
+	ttl      time.Duration
+	objects  bool
+	dryRun   bool
+	now      func() time.Time
+}
+
+func newGC(c gcConfig) *gc {
+	return &gc{interval: c.interval, ttl: c.ttl, objects: c.Objects, dryRun: c.DryRun, now: time.Now}
+}
+
+// gcRemoval is an entry removed by the garbage collection and the reason.
+type gcRemoval struct {
+	entry  *eventTicket
+	reason string
+}
+
+// lastActivity returns the time of the last event or action of the entry.
+func (et *eventTicket) lastActivity() time.Time {
+	last := et.Created
+
+	if et.Event.Timestamp != 0 {
+		if x := time.Unix(0, int64(et.Event.Timestamp*float64(time.Second))); x.After(last) {
+			last = x
+		}
+	}
+
+	if n := len(et.History); n > 0 && et.History[n-1].Time.After(last) {
+		last = et.History[n-1].Time
+	}
+
+	if et.Resolved.After(last) {
+		last = et.Resolved
+	}
+
+	return last
+}
+
+// gcReason returns why the entry is garbage, or an empty string if it isn't.
+func (t *ticketUpdater) gcReason(et *eventTicket, now time.Time) (string, error) {
+	// group entries are named after their group, which isn't an Icinga object.
+	group := isGroupEvent(et.Event)
+
+	if t.gc.objects && t.objects != nil && !group {
+		var err error
+		if et.Event.Service == "" {
+			_, err = t.objects.Host(et.Event.Host)
+		} else {
+			_, err = t.objects.Service(et.Event.Host, et.Event.Service)
+		}
+
+		switch err {
+		case nil:
+		case objects.ErrNotFound:
+			return fmt.Sprintf("%v doesn't exist", objectType(et.Event)), nil
+		default:
+			return "", err
+		}
+	}
+
+	if et.TicketID == -1 {
+		return "", nil
+	}
+
+	// resolved tickets are kept as long as they can be reopened.
+	if !et.Resolved.IsZero() && (t.reopenWindow == 0 || now.Sub(et.Resolved) < t.reopenWindow) {
+		return "", nil
+	}
+
+	// entries saved by older versions may not have any times.
+	last := et.lastActivity()
+	idle := now.Sub(last)
+	if !last.IsZero() && idle < t.gc.ttl {
+		return "", nil
+	}
+
+	ticket, err := t.rtClient.Ticket(et.TicketID)
+	if err != nil {
+		return "", err
+	}
+
+	if !t.closed(ticket) {
+		return "", nil
+	}
+
+	if last.IsZero() {
+		return fmt.Sprintf("ticket #%v is %v, last activity unknown", et.TicketID, ticket.Status), nil
+	}
+
+	return fmt.Sprintf("ticket #%v is %v and idle for %v", et.TicketID, ticket.Status, idle.Truncate(time.Second)), nil
+}
+
+// collectGarbage removes the stale entries of the cache and returns them. If dryRun is true, nothing is removed.
+// The entries are checked without holding t.mu, as this needs requests to RT and Icinga, so events are processed
+// meanwhile. The lock is only held to remove an entry, if it didn't change since it was checked, so t.mu must not be
+// held by the caller.
+func (t *ticketUpdater) collectGarbage(dryRun bool) ([]gcRemoval, error) {
+	ets, err := t.cache.allEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	now := t.gc.now()
+
+	removed := []gcRemoval{}
+	for _, et := range ets {
+		reason, err := t.gcReason(et, now)
+		if err != nil {
+			log.Printf("%x ticket updater: gc couldn't check %s: %v", eventID(et.Event), t.cache.key(et.Event), err)
+			continue
+		}
+
+		if reason == "" {
+			continue
+		}
+
+		if dryRun {
+			log.Printf("%x ticket updater: gc would remove %s: %v", eventID(et.Event), t.cache.key(et.Event), reason)
+			removed = append(removed, gcRemoval{entry: et, reason: reason})
+			continue
+		}
+
+		ok, err := t.removeGarbage(et, reason, now)
+		if err != nil {
+			return removed, err
+		}
+
+		if ok {
+			removed = append(removed, gcRemoval{entry: et, reason: reason})
+		}
+	}
+
+	return removed, nil
+}
+
+// removeGarbage removes the stale entry unless an event changed it since it was checked. It returns true if the entry
+// was removed.
+func (t *ticketUpdater) removeGarbage(et *eventTicket, reason string, now time.Time) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, err := t.cache.getEntry(et.Event)
+	if err != nil {
+		return false, err
+	}
+
+	if current == nil || current.TicketID != et.TicketID || !current.lastActivity().Equal(et.lastActivity()) {
+		if *debug {
+			log.Printf("%x ticket updater: gc keeps %s, it changed since it was checked", eventID(et.Event), t.cache.key(et.Event))
+		}
+		return false, nil
+	}
+
+	if err := t.cache.deleteEventTicket(et.Event); err != nil {
+		return false, err
+	}
+
+	log.Printf("%x ticket updater: gc removed %s: %v", eventID(et.Event), t.cache.key(et.Event), reason)
+
+	if t.audit != nil {
+		a := &auditEntry{Time: now.UTC(), State: stateString(et.Event), Action: "gc: " + reason, TicketID: et.TicketID}
+		if err := t.cache.putAudit(et.Event, a, t.audit.entries, now.Add(-t.audit.maxAge)); err != nil {
+			log.Printf("%x ticket updater: couldn't save audit entry: %v", eventID(et.Event), err)
+		}
+	}
+
+	return true, nil
+}
+
+// runGC collects garbage in the gc interval, it doesn't return.
+func (t *ticketUpdater) runGC() {
+	for range time.Tick(t.gc.interval) {
+		removed, err := t.collectGarbage(t.gc.dryRun)
+
+		if err != nil {
+			log.Printf("ticket updater: gc failed: %v", err)
+			continue
+		}
+
+		if *debug {
+			log.Printf("ticket updater: gc found %v stale entries", len(removed))
+		}
+	}
+}
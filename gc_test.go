@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/objects"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	dummy := NewDummyRT()
+	for _, v := range []string{"resolved", "resolved", "open", "resolved"} {
+		if _, err := dummy.NewTicket(&rt.Ticket{Status: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Date(2017, 7, 14, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-48 * time.Hour)
+
+	entries := []*eventTicket{
+		// closed and idle
+		{Event: newTestEvent("web01", "http", event.StateCritical), TicketID: 0, Created: old},
+		// closed, but recently active
+		{Event: newTestEvent("web01", "ssh", event.StateCritical), TicketID: 1, Created: old, History: []historyEntry{{Time: now.Add(-time.Hour)}}},
+		// open
+		{Event: newTestEvent("web01", "disk", event.StateCritical), TicketID: 2, Created: old},
+		// the service doesn't exist anymore
+		{Event: newTestEvent("web01", "gone", event.StateCritical), TicketID: -1, Created: now},
+		// resolved and idle, but still within the reopen window
+		{Event: newTestEvent("web01", "mail", event.StateCritical), TicketID: 3, Created: old, Resolved: old},
+	}
+
+	for _, v := range entries {
+		if err := cache.putEntry(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tu := newTicketUpdater(cache, dummy, nil, "", "Test-Queue", []string{"resolved"})
+	tu.objects = &DummyObjects{services: map[string]*objects.Service{
+		"web01!http": {Host: "web01", Name: "http"},
+		"web01!ssh":  {Host: "web01", Name: "ssh"},
+		"web01!disk": {Host: "web01", Name: "disk"},
+		"web01!mail": {Host: "web01", Name: "mail"},
+	}}
+	tu.gc = newGC(gcConfig{ttl: 24 * time.Hour, Objects: true})
+	tu.gc.now = func() time.Time { return now }
+	tu.reopenWindow = 72 * time.Hour
+	tu.audit = newAudit(auditConfig{})
+
+	removed, err := tu.collectGarbage(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 2 {
+		t.Fatalf("expected 2 stale entries, got %+v", removed)
+	}
+
+	ets, err := cache.allEntries()
+	if err != nil || len(ets) != 5 {
+		t.Fatalf("dry run removed entries: %v %v", len(ets), err)
+	}
+
+	removed, err = tu.collectGarbage(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// entries are ordered by their keys.
+	if len(removed) != 2 || removed[0].reason != "service doesn't exist" || !strings.Contains(removed[1].reason, "idle for 48h0m0s") {
+		t.Errorf("unexpected removals: %+v %+v", removed[0], removed[1])
+	}
+
+	ets, err = cache.allEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range ets {
+		if v.Event.Service == "http" || v.Event.Service == "gone" {
+			t.Errorf("stale entry wasn't removed: %+v", v.Event)
+		}
+	}
+
+	as, err := cache.getAudit(entries[0].Event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(as) != 1 || !strings.HasPrefix(as[0].Action, "gc: ticket #0 is resolved") {
+		t.Errorf("removal wasn't audited: %+v", as)
+	}
+}
+
+func TestCacheGCCommand(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	dummy := NewDummyRT()
+	if _, err := dummy.NewTicket(&rt.Ticket{Status: "resolved"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.putEntry(&eventTicket{Event: testEvent, TicketID: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	env := &commandEnv{
+		cache:    cache,
+		conf:     &config{Ticket: ticketConfig{ClosedStatus: []string{"resolved"}}, Cache: cacheConfig{GC: gcConfig{ttl: time.Hour}}},
+		rtClient: func() (rtClient, error) { return dummy, nil },
+		out:      &out,
+	}
+
+	if err := runCommand(env, []string{"cache", "gc", "-dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(out.String(), "would remove service/example.com/example") {
+		t.Errorf("unexpected report: %v", out.String())
+	}
+
+	if et, err := cache.getEntry(testEvent); err != nil || et == nil {
+		t.Errorf("dry run removed entry: %v", err)
+	}
+
+	env.conf.Cache.GC.ttl = 0
+	if err := runCommand(env, []string{"cache", "gc"}); err == nil {
+		t.Error("expected error without TTL")
+	}
+}
+
+func TestRemoveGarbageChanged(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	now := time.Date(2017, 7, 14, 12, 0, 0, 0, time.UTC)
+	checked := &eventTicket{Event: newTestEvent("web01", "http", event.StateCritical), TicketID: 1, Created: now.Add(-48 * time.Hour)}
+
+	// an event updated the entry after it was checked.
+	changed := *checked
+	changed.History = []historyEntry{{Time: now, Action: "comment"}}
+	if err := cache.putEntry(&changed); err != nil {
+		t.Fatal(err)
+	}
+
+	tu := newTicketUpdater(cache, NewDummyRT(), nil, "", "Test-Queue", []string{"resolved"})
+	tu.gc = newGC(gcConfig{ttl: time.Hour})
+
+	removed, err := tu.removeGarbage(checked, "idle", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if et, err := cache.getEntry(checked.Event); removed || err != nil || et == nil {
+		t.Errorf("changed entry was removed: %v %v", et, err)
+	}
+}
@@ -5,4 +5,5 @@ require (
 	github.com/bytemine/go-icinga2 v0.0.4
 	github.com/etcd-io/bbolt v1.3.0
 	golang.org/x/sys v0.0.0-20181005133103-4497e2df6f9e // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/objects"
+)
+
+// groupKeyTTL is the time group keys of hosts are cached, so the objects API isn't asked for every event.
+const groupKeyTTL = 10 * time.Minute
+
+// streamTypeGroup marks the events of groups. Their entries are saved apart from the entries of hosts of the same
+// name, see cache.key.
+const streamTypeGroup event.StreamType = "Group"
+
+// groupKeyLookup is a cached group key of a host.
+type groupKeyLookup struct {
+	key     string
+	expires time.Time
+}
+
+// newGroupEvent returns the event of the group with the key. Group events look like host events, but their state is
+// the most severe state of their members, so they have no host state. They are told apart by their stream type.
+func newGroupEvent(key string) *event.Notification {
+	g := &event.Notification{Host: key}
+	g.Type = streamTypeGroup
+	return g
+}
+
+// isGroupEvent returns true if the event was returned by newGroupEvent.
+func isGroupEvent(e *event.Notification) bool {
+	return e.Type == streamTypeGroup
+}
+
+// Grouping keys. Events with the same key share one ticket.
+const (
+	groupingHost      = "host"
+	groupingHostgroup = "hostgroup"
+	// groupingVarPrefix is followed by the name of a custom variable of the host.
+	groupingVarPrefix = "var:"
+)
+
+func checkGrouping(grouping string) error {
+	switch {
+	case grouping == "", grouping == groupingHost, grouping == groupingHostgroup:
+		return nil
+	case strings.HasPrefix(grouping, groupingVarPrefix) && len(grouping) > len(groupingVarPrefix):
+		return nil
+	default:
+		return fmt.Errorf("invalid grouping: %v", grouping)
+	}
+}
+
+// groupKey returns the key of the group the event is a member of. If the key can't be determined, the host name is used.
+// Keys looked up with the objects API are cached for groupKeyTTL.
+func (t *ticketUpdater) groupKey(e *event.Notification) string {
+	if t.grouping == groupingHost || t.objects == nil {
+		return e.Host
+	}
+
+	now := time.Now()
+	if x, ok := t.groupKeys[e.Host]; ok && now.Before(x.expires) {
+		return x.key
+	}
+
+	host, err := t.objects.Host(e.Host)
+	if err != nil {
+		// not cached, so the lookup is tried again with the next event.
+		log.Printf("ticket updater: couldn't look up host %v, grouping by host name: %v", e.Host, err)
+		return e.Host
+	}
+
+	key := hostGroupKey(t.grouping, e.Host, host)
+
+	if t.groupKeys == nil {
+		t.groupKeys = make(map[string]groupKeyLookup)
+	}
+	t.groupKeys[e.Host] = groupKeyLookup{key: key, expires: now.Add(groupKeyTTL)}
+
+	return key
+}
+
+// hostGroupKey returns the key of the host by the grouping, or its name if it hasn't the attribute.
+func hostGroupKey(grouping string, name string, host *objects.Host) string {
+	switch {
+	case grouping == groupingHostgroup:
+		if len(host.Groups) == 0 {
+			return name
+		}
+
+		groups := append([]string{}, host.Groups...)
+		sort.Strings(groups)
+		return groups[0]
+	case strings.HasPrefix(grouping, groupingVarPrefix):
+		v, ok := host.Vars[strings.TrimPrefix(grouping, groupingVarPrefix)]
+		if !ok || v == nil {
+			return name
+		}
+
+		return fmt.Sprint(v)
+	}
+
+	return name
+}
+
+// memberName returns the name of the event in a group, like the full name of services in Icinga.
+func memberName(e *event.Notification) string {
+	if e.Service == "" {
+		return e.Host
+	}
+
+	return e.Host + "!" + e.Service
+}
+
+// severity orders states from OK to CRITICAL.
+func severity(s event.State) int {
+	switch s {
+	case event.StateOK:
+		return 0
+	case event.StateWarning:
+		return 1
+	case event.StateUnknown:
+		return 2
+	case event.StateCritical:
+		return 3
+	default:
+		return -1
+	}
+}
+
+// worstState returns the most severe state of the members, or OK if there are no members.
+func worstState(members map[string]event.State) event.State {
+	worst := event.State(event.StateOK)
+	for _, v := range members {
+		if severity(v) > severity(worst) {
+			worst = v
+		}
+	}
+
+	return worst
+}
+
+// formatMembers lists the failing members sorted by name.
+func formatMembers(members map[string]event.State) string {
+	if len(members) == 0 {
+		return "All members recovered."
+	}
+
+	names := make([]string, 0, len(members))
+	for k := range members {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	failing := make([]string, 0, len(names))
+	for _, v := range names {
+		failing = append(failing, fmt.Sprintf("%v (%v)", v, members[v].String()))
+	}
+
+	return fmt.Sprintf("Failing: %v", strings.Join(failing, ", "))
+}
+
+func formatGroupSubject(grouping string, e *event.Notification) string {
+	label := "Host"
+
+	switch {
+	case grouping == groupingHostgroup:
+		label = "Hostgroup"
+	case strings.HasPrefix(grouping, groupingVarPrefix):
+		label = strings.TrimPrefix(grouping, groupingVarPrefix)
+	}
+
+	return fmt.Sprintf("%v: %v is %v", label, e.Host, e.CheckResult.State.String())
+}
+
+// failingMember returns an event of the most severe member, or nil if no member is failing. Pending creations of
+// groups only keep the states of their members, so this event is routed instead of the member which was updated.
+func failingMember(members map[string]event.State) *event.Notification {
+	names := make([]string, 0, len(members))
+	for k := range members {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var worst *event.Notification
+	for _, v := range names {
+		if worst != nil && severity(members[v]) <= severity(worst.CheckResult.State) {
+			continue
+		}
+
+		host, service := v, ""
+		if i := strings.Index(v, "!"); i != -1 {
+			host, service = v[:i], v[i+1:]
+		}
+
+		worst = &event.Notification{Host: host, Service: service}
+		worst.CheckResult.State = members[v]
+	}
+
+	return worst
+}
+
+// routingEvent returns the event routing rules are applied to. Group tickets are routed by the member whose update
+// created them, as the host of a group event is its key.
+func (t *ticketUpdater) routingEvent(e *event.Notification) *event.Notification {
+	if isGroupEvent(e) && t.member != nil {
+		return t.member
+	}
+
+	return e
+}
+
+// formatGroupComment returns the comment of group ticket updates, using the state of the group instead of a host state.
+func formatGroupComment(e *event.Notification) string {
+	if e.CheckResult.Output != "" {
+		return fmt.Sprintf("New status: %v Output: %v", e.CheckResult.State.String(), e.CheckResult.Output)
+	}
+
+	return e.CheckResult.State.String()
+}
+
+// updateGroup handles an event as member of its group. The group is handled like a single event with the most severe
+// state of its members, so the mappings are applied to the group whenever this state changes. Other changes of members
+// are added as comment to the group ticket. key is the group key of the event.
+func (t *ticketUpdater) updateGroup(e *event.Notification, key string) error {
+	g := newGroupEvent(key)
+	g.Users, g.NotificationType, g.Author, g.Text = e.Users, e.NotificationType, e.Author, e.Text
+
+	entry, err := t.cache.getEntry(g)
+	if err != nil {
+		return err
+	}
+
+	open := entry != nil && entry.TicketID != -1 && t.openTicket(entry.TicketID)
+
+	// members of closed tickets are forgotten.
+	members := make(map[string]event.State)
+	oldState := event.State(event.StateNil)
+	if open {
+		for k, v := range entry.Members {
+			members[k] = v
+		}
+		oldState = entry.Event.CheckResult.State
+	} else {
+		// members of a group waiting for its ticket are kept with the pending creation.
+		p, err := t.cache.getPending(g)
+		if err != nil {
+			return err
+		}
+
+		if p != nil {
+			for k, v := range p.Members {
+				members[k] = v
+			}
+		}
+	}
+
+	name := memberName(e)
+	previous, failing := members[name]
+
+	if e.CheckResult.State == event.StateOK {
+		delete(members, name)
+	} else {
+		members[name] = e.CheckResult.State
+	}
+
+	g.CheckResult = event.CheckResultData{State: worstState(members), Output: formatMembers(members)}
+
+	if *debug {
+		log.Printf("%x ticket updater: event %v is member of group %v: %v", eventID(e), name, g.Host, g.CheckResult.Output)
+	}
+
+	if open && g.CheckResult.State == oldState {
+		// member events which don't change the group, like acknowledgements, are only recorded.
+		changed := failing != (e.CheckResult.State != event.StateOK) || (failing && previous != e.CheckResult.State)
+		if !changed {
+			t.auditAction("", "group member")
+		} else {
+			t.auditAction("", "group comment")
+			comment := fmt.Sprintf("%v %v", formatEventSubject(e), g.CheckResult.Output)
+			if err := t.rtClient.CommentTicket(entry.TicketID, comment); err != nil {
+				return err
+			}
+
+			if *debug {
+				log.Printf("%x ticket updater: commented group ticket #%v", eventID(g), entry.TicketID)
+			}
+		}
+
+		entry.Event = g
+		entry.Members = members
+		return t.cache.putEntry(entry)
+	}
+
+	t.member = e
+	err = t.match(g)
+	t.member = nil
+	if err != nil {
+		return err
+	}
+
+	// the action may have delayed the creation, created, updated or removed the entry,
+	// so save the members to whatever is left.
+	p, err := t.cache.getPending(g)
+	if err != nil {
+		return err
+	}
+
+	if p != nil {
+		p.Members = members
+		return t.cache.putPending(p)
+	}
+
+	entry, err = t.cache.getEntry(g)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	entry.Members = members
+	return t.cache.putEntry(entry)
+}
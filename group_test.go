@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/filter"
+	"github.com/bytemine/icinga2rt/objects"
+)
+
+// DummyObjects is a mock Icinga2 objects API client used for testing.
+type DummyObjects struct {
+	hosts    map[string]*objects.Host
+	users    map[string]*objects.User
+	services map[string]*objects.Service
+}
+
+func (d *DummyObjects) Host(name string) (*objects.Host, error) {
+	h, ok := d.hosts[name]
+	if !ok {
+		return nil, objects.ErrNotFound
+	}
+	return h, nil
+}
+
+func (d *DummyObjects) User(name string) (*objects.User, error) {
+	u, ok := d.users[name]
+	if !ok {
+		return nil, objects.ErrNotFound
+	}
+	return u, nil
+}
+
+func (d *DummyObjects) Service(host string, name string) (*objects.Service, error) {
+	s, ok := d.services[host+"!"+name]
+	if !ok {
+		return nil, objects.ErrNotFound
+	}
+	return s, nil
+}
+
+var testObjects = &DummyObjects{
+	hosts: map[string]*objects.Host{
+		"web01": {Name: "web01", Groups: []string{"web", "linux"}, Vars: map[string]interface{}{"customer": "acme"}},
+		"web02": {Name: "web02", Groups: []string{"web"}, Vars: map[string]interface{}{"customer": "acme"}},
+	},
+	users: map[string]*objects.User{
+		"jdoe":   {Name: "jdoe", Email: "jdoe@example.com"},
+		"nomail": {Name: "nomail"},
+	},
+}
+
+func TestGroupKey(t *testing.T) {
+	tests := []struct {
+		Grouping string
+		Host     string
+		Key      string
+	}{
+		{Grouping: groupingHost, Host: "web01", Key: "web01"},
+		{Grouping: groupingHostgroup, Host: "web01", Key: "linux"},
+		{Grouping: groupingHostgroup, Host: "web02", Key: "web"},
+		{Grouping: groupingHostgroup, Host: "unknown", Key: "unknown"},
+		{Grouping: "var:customer", Host: "web02", Key: "acme"},
+		{Grouping: "var:missing", Host: "web02", Key: "web02"},
+	}
+
+	for _, v := range tests {
+		tu := &ticketUpdater{grouping: v.Grouping, objects: testObjects}
+		key := tu.groupKey(&event.Notification{Host: v.Host, Service: "http"})
+		if key != v.Key {
+			t.Errorf("grouping %v host %v: got key %v, expected %v", v.Grouping, v.Host, key, v.Key)
+		}
+	}
+}
+
+func TestGroupKeyCache(t *testing.T) {
+	objs := &DummyObjects{hosts: map[string]*objects.Host{
+		"web01": {Name: "web01", Vars: map[string]interface{}{"customer": "acme"}},
+	}}
+
+	tu := &ticketUpdater{grouping: "var:customer", objects: objs}
+	if key := tu.groupKey(newTestEvent("web01", "http", event.StateCritical)); key != "acme" {
+		t.Fatalf("got key %v, expected acme", key)
+	}
+
+	// the lookup is cached, so the host isn't looked up again.
+	delete(objs.hosts, "web01")
+	if key := tu.groupKey(newTestEvent("web01", "ssh", event.StateCritical)); key != "acme" {
+		t.Errorf("got key %v, expected the cached key acme", key)
+	}
+}
+
+func TestGroupEventKey(t *testing.T) {
+	// a group named like a host doesn't share the entry of the host.
+	c := &cache{}
+	if g, h := c.key(newGroupEvent("web01")), c.key(newTestEvent("web01", "", event.StateCritical)); bytes.Equal(g, h) {
+		t.Errorf("group and host have the same key %s", g)
+	}
+
+	if !isGroupEvent(newGroupEvent("web01")) || isGroupEvent(newTestEvent("web01", "", event.StateCritical)) {
+		t.Error("group events not told apart from host events")
+	}
+}
+
+func TestCheckGrouping(t *testing.T) {
+	for _, v := range []string{"", "host", "hostgroup", "var:customer"} {
+		if err := checkGrouping(v); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, v := range []string{"service", "var:"} {
+		if err := checkGrouping(v); err == nil {
+			t.Errorf("expected error for grouping %v", v)
+		}
+	}
+}
+
+func TestTicketUpdaterGroup(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+	tu.grouping = "var:customer"
+	tu.objects = testObjects
+	tu.routing = []routingRule{{Filter: filter.Filter{Host: "web01"}, Queue: "Web"}}
+	tu.audit = newAudit(auditConfig{})
+
+	steps := []struct {
+		Event    *event.Notification
+		Tickets  int // number of tickets created after processing
+		Comments int // number of comments on the first ticket after processing
+		Members  int // number of failing members after processing
+	}{
+		{Event: newTestEvent("web01", "http", event.StateCritical), Tickets: 1, Comments: 0, Members: 1},
+		{Event: newTestEvent("web02", "http", event.StateWarning), Tickets: 1, Comments: 1, Members: 2},
+		{Event: newTestEvent("web02", "http", event.StateWarning), Tickets: 1, Comments: 1, Members: 2},
+		{Event: newTestEvent("web01", "http", event.StateOK), Tickets: 1, Comments: 2, Members: 1},
+		{Event: newTestEvent("web02", "http", event.StateOK), Tickets: 1, Comments: 2, Members: 0},
+		{Event: newTestEvent("web02", "http", event.StateCritical), Tickets: 2, Comments: 2, Members: 1},
+	}
+
+	for i, v := range steps {
+		if err := tu.update(v.Event); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rt.tickets) != v.Tickets {
+			t.Errorf("step %v: got %v tickets, expected %v", i, len(rt.tickets), v.Tickets)
+		}
+
+		if len(rt.comments[0]) != v.Comments {
+			t.Errorf("step %v: got %v comments, expected %v", i, len(rt.comments[0]), v.Comments)
+		}
+
+		entry, err := cache.getEntry(newGroupEvent("acme"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		members := 0
+		if entry != nil {
+			members = len(entry.Members)
+		}
+
+		if members != v.Members {
+			t.Errorf("step %v: got %v members, expected %v", i, members, v.Members)
+		}
+	}
+
+	if rt.tickets[0].Status != "deleted" {
+		t.Errorf("first ticket wasn't deleted after all members recovered")
+	}
+
+	if rt.tickets[1].Subject != "customer: acme is CRITICAL" {
+		t.Errorf("unexpected subject: %v", rt.tickets[1].Subject)
+	}
+
+	// routed by the host of the member creating the ticket, not the group key.
+	if rt.tickets[0].Queue != "Web" || rt.tickets[1].Queue != "Test-Queue" {
+		t.Errorf("unexpected queues: %v, %v", rt.tickets[0].Queue, rt.tickets[1].Queue)
+	}
+
+	as, err := cache.getAudit(newTestEvent("web02", "http", event.StateWarning))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(as) != 4 || as[0].Action != "group comment" || as[1].Action != "group member" {
+		t.Errorf("unexpected audit entries of the member: %v", as)
+	}
+}
+
+func TestFailingMember(t *testing.T) {
+	if x := failingMember(map[string]event.State{}); x != nil {
+		t.Errorf("expected no member, got %v", x)
+	}
+
+	x := failingMember(map[string]event.State{"web01!http": event.StateWarning, "web02!http": event.StateCritical, "web03": event.StateCritical})
+	if x == nil || x.Host != "web02" || x.Service != "http" || x.CheckResult.State != event.StateCritical {
+		t.Errorf("expected web02!http, got %v", x)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// ticketIndexBucketName is the bucket of the index from ticket IDs to the keys of the events bucket. Several keys can
+// share a ticket, like folded services and their host.
+const ticketIndexBucketName = "tickets"
+
+// ticketPrefix is the prefix of the index keys of a ticket, the ticket ID in big endian order.
+func ticketPrefix(ticketID int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(ticketID))
+	return k
+}
+
+// ticketIndexKey is the index key of the event key of a ticket.
+func ticketIndexKey(ticketID int, key []byte) []byte {
+	return append(ticketPrefix(ticketID), key...)
+}
+
+// indexTicket adds the event key to the index of the ticket. Entries without ticket aren't indexed.
+func indexTicket(tx StoreTx, ticketID int, key []byte) error {
+	if ticketID < 0 {
+		return nil
+	}
+
+	return tx.Put(ticketIndexBucketName, ticketIndexKey(ticketID, key), []byte{})
+}
+
+// unindexEntry removes the entry at key of the events bucket from the index of its ticket.
+func unindexEntry(tx StoreTx, key []byte) error {
+	x := tx.Get(eventBucketName, key)
+	if x == nil {
+		return nil
+	}
+
+	// undecodable entries can't be indexed, checkTicketIndex removes their stale index keys.
+	old, err := decodeEventTicket(x)
+	if err != nil || old.TicketID < 0 {
+		return nil
+	}
+
+	return tx.Delete(ticketIndexBucketName, ticketIndexKey(old.TicketID, key))
+}
+
+// lookupTicket returns the entries of the ticket, ordered by their keys.
+func (c *cache) lookupTicket(ticketID int) ([]*eventTicket, error) {
+	ets := []*eventTicket{}
+
+	if ticketID < 0 {
+		return ets, nil
+	}
+
+	err := c.Store.View(func(tx StoreTx) error {
+		prefix := ticketPrefix(ticketID)
+
+		return tx.ForEach(ticketIndexBucketName, prefix, func(k, v []byte) error {
+			x := tx.Get(eventBucketName, k[len(prefix):])
+			if x == nil {
+				return nil
+			}
+
+			et, err := decodeEventTicket(x)
+			if err != nil {
+				return err
+			}
+
+			ets = append(ets, et)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ets, nil
+}
+
+// checkTicketIndex compares the ticket index with the entries of the events bucket and rebuilds it if it drifted,
+// returning true if it was rebuilt. Undecodable entries aren't indexed.
+func (c *cache) checkTicketIndex() (bool, error) {
+	rebuilt := false
+
+	err := c.Store.Update(func(tx StoreTx) error {
+		expected := map[string]bool{}
+
+		err := tx.ForEach(eventBucketName, nil, func(k, v []byte) error {
+			et, err := decodeEventTicket(v)
+			if err != nil || et.TicketID < 0 {
+				return nil
+			}
+
+			expected[string(ticketIndexKey(et.TicketID, k))] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		actual := 0
+		drifted := false
+
+		err = tx.ForEach(ticketIndexBucketName, nil, func(k, v []byte) error {
+			actual++
+			if !expected[string(k)] {
+				drifted = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if !drifted && actual == len(expected) {
+			return nil
+		}
+
+		if err := tx.DeleteBucket(ticketIndexBucketName); err != nil {
+			return err
+		}
+
+		for k := range expected {
+			if err := tx.Put(ticketIndexBucketName, []byte(k), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		rebuilt = true
+		return nil
+	})
+
+	return rebuilt, err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func TestLookupTicket(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	host := newTestEvent("example.com", "", event.StateCritical)
+	service := newTestEvent("example.com", "http", event.StateCritical)
+
+	if err := cache.updateEventTicket(host, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// folded services share the ticket of their host.
+	if err := cache.putEntry(&eventTicket{Event: service, TicketID: 1, Folded: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ets, err := cache.lookupTicket(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ets) != 2 || ets[0].Event.Service != "" || ets[1].Event.Service != "http" {
+		t.Fatalf("expected entries of host and service, got %+v", ets)
+	}
+
+	if err := cache.updateEventTicket(service, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if ets, err := cache.lookupTicket(1); err != nil || len(ets) != 1 {
+		t.Errorf("index of replaced ticket wasn't removed: %v %v", len(ets), err)
+	}
+
+	if ets, err := cache.lookupTicket(2); err != nil || len(ets) != 1 || ets[0].Event.Service != "http" {
+		t.Errorf("replaced ticket wasn't indexed: %+v %v", ets, err)
+	}
+
+	if err := cache.deleteEventTicket(host); err != nil {
+		t.Fatal(err)
+	}
+
+	if ets, err := cache.lookupTicket(1); err != nil || len(ets) != 0 {
+		t.Errorf("index of deleted entry wasn't removed: %v %v", len(ets), err)
+	}
+
+	// entries without ticket aren't indexed.
+	if err := cache.updateEventTicket(host, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if ets, err := cache.lookupTicket(-1); err != nil || len(ets) != 0 {
+		t.Errorf("entry without ticket was indexed: %v %v", len(ets), err)
+	}
+}
+
+func TestCheckTicketIndex(t *testing.T) {
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	for i, v := range []string{"http", "ssh"} {
+		if err := cache.updateEventTicket(newTestEvent("example.com", v, event.StateCritical), i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rebuilt, err := cache.checkTicketIndex()
+	if err != nil || rebuilt {
+		t.Fatalf("index was rebuilt without drift: %v", err)
+	}
+
+	// let the index drift: a stale key and a missing key.
+	err = cache.Store.Update(func(tx StoreTx) error {
+		if err := tx.Put(ticketIndexBucketName, ticketIndexKey(3, []byte("service/example.com/gone")), []byte{}); err != nil {
+			return err
+		}
+
+		return tx.Delete(ticketIndexBucketName, ticketIndexKey(2, cache.key(&event.Notification{Host: "example.com", Service: "ssh"})))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt, err = cache.checkTicketIndex()
+	if err != nil || !rebuilt {
+		t.Fatalf("drifted index wasn't rebuilt: %v", err)
+	}
+
+	if ets, err := cache.lookupTicket(2); err != nil || len(ets) != 1 {
+		t.Errorf("missing key wasn't restored: %v %v", len(ets), err)
+	}
+
+	err = cache.Store.View(func(tx StoreTx) error {
+		if n := countKeys(tx, ticketIndexBucketName); n != 2 {
+			t.Errorf("expected 2 index keys, got %v", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// fileLock is an exclusive lock of a file, released by Close.
+type fileLock struct {
+	path string
+}
+
+// lockFile locks the file at path exclusively by creating it, waiting cacheLockTimeout for the lock. The file is
+// removed by Close, it has to be removed manually if the process exits without closing the lock.
+func lockFile(path string) (*fileLock, error) {
+	deadline := time.Now().Add(cacheLockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			if err := f.Close(); err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+
+			return &fileLock{path: path}, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("cache %v is locked, icinga2rt is probably running and has to be stopped first", path)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (l *fileLock) Close() error {
+	return os.Remove(l.path)
+}
@@ -0,0 +1,47 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileLock is an exclusive lock of a file, released by Close.
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile locks the file at path exclusively, waiting cacheLockTimeout for the lock. The lock is released if the
+// process exits.
+func lockFile(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(cacheLockTimeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &fileLock{f: f}, nil
+		}
+
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, fmt.Errorf("cache %v is locked, icinga2rt is probably running and has to be stopped first", path)
+			}
+			return nil, err
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (l *fileLock) Close() error {
+	return l.f.Close()
+}
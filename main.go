@@ -11,6 +11,7 @@ import (
 
 	"github.com/bytemine/go-icinga2"
 	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/objects"
 	"github.com/bytemine/icinga2rt/rt"
 )
 
@@ -61,6 +62,13 @@ type rtClient interface {
 	CommentTicket(int, string) error
 }
 
+// objectsClient interface enables to use a dummy client for testing.
+type objectsClient interface {
+	Host(string) (*objects.Host, error)
+	User(string) (*objects.User, error)
+	Service(string, string) (*objects.Service, error)
+}
+
 func main() {
 	flag.Parse()
 
@@ -86,7 +94,12 @@ func main() {
 		log.Fatal("FATAL: init:", err)
 	}
 
-	eventCache, err := openCache(conf.Cache.File)
+	store, err := openStore(conf.Cache.Backend, conf.Cache.File)
+	if err != nil {
+		log.Fatal("FATAL: init:", err)
+	}
+
+	eventCache, err := newCache(store, conf.Cache.Namespace)
 	if err != nil {
 		log.Fatal("FATAL: init:", err)
 	}
@@ -111,6 +124,29 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flag.NArg() != 0 {
+		env := &commandEnv{
+			cache: eventCache,
+			conf:  conf,
+			rtClient: func() (rtClient, error) {
+				return rt.NewClient(conf.RT.URL, conf.RT.User, conf.RT.Password, conf.RT.Insecure)
+			},
+			objects: func() (objectsClient, error) {
+				return objects.NewClient(conf.Icinga.URL, conf.Icinga.User, conf.Icinga.Password, conf.Icinga.Insecure)
+			},
+			in:  os.Stdin,
+			out: os.Stdout,
+		}
+
+		err := runCommand(env, flag.Args())
+		eventCache.Close()
+		if err != nil {
+			log.Fatal("FATAL: ", err)
+		}
+
+		os.Exit(0)
+	}
+
 	if *importCache != "" {
 		var f io.ReadCloser
 		if *importCache == "-" {
@@ -137,6 +173,61 @@ func main() {
 	}
 
 	tu := newTicketUpdater(eventCache, rtClient, conf.Ticket.mappings, conf.Ticket.Nobody, conf.Ticket.Queue, conf.Ticket.ClosedStatus)
+	tu.routing = conf.Ticket.Routing
+	tu.hostFolding = conf.Ticket.HostFolding
+	tu.grouping = conf.Ticket.Grouping
+	tu.createDelay = conf.Ticket.createDelay
+	tu.reopenWindow = conf.Ticket.reopenWindow
+	tu.notifications = conf.Ticket.Notifications
+	tu.sla = conf.Ticket.SLA
+
+	if len(conf.Ticket.schedules) != 0 {
+		tu.schedules = newSchedules(conf.Ticket.schedules)
+	}
+
+	if conf.Ticket.ResolvedStatus != "" {
+		tu.resolvedStatus = conf.Ticket.ResolvedStatus
+	}
+
+	if conf.Ticket.OpenStatus != "" {
+		tu.openStatus = conf.Ticket.OpenStatus
+	}
+
+	if conf.Ticket.Storm.Threshold > 0 {
+		tu.storm = newStorm(conf.Ticket.Storm.Threshold, conf.Ticket.Storm.window, conf.Ticket.Storm.Queue)
+	}
+
+	tu.objects, err = objects.NewClient(conf.Icinga.URL, conf.Icinga.User, conf.Icinga.Password, conf.Icinga.Insecure)
+	if err != nil {
+		log.Fatal("FATAL: init:", err)
+	}
+
+	if conf.Ticket.Users.Field != "" || len(conf.Ticket.Users.Owners) != 0 {
+		tu.users = newUsers(conf.Ticket.Users, tu.objects)
+	}
+
+	if err := tu.restorePending(); err != nil {
+		log.Fatal("FATAL: init:", err)
+	}
+
+	if !conf.Cache.Audit.Disable {
+		tu.audit = newAudit(conf.Cache.Audit)
+		go tu.runAuditPrune()
+	}
+
+	if conf.Cache.Backup.Dir != "" {
+		go eventCache.runBackup(conf.Cache)
+	}
+
+	if conf.Cache.GC.interval > 0 {
+		tu.gc = newGC(conf.Cache.GC)
+		go tu.runGC()
+	}
+
+	if len(conf.Ticket.Escalation.Steps) != 0 {
+		tu.escalation = newEscalation(conf.Ticket.Escalation)
+		go tu.runEscalation()
+	}
 
 	icingaClient, err := icinga2.NewClient(conf.Icinga.URL, conf.Icinga.User, conf.Icinga.Password, conf.Icinga.Insecure)
 	if err != nil {
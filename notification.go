@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+// Actions of notification handlings.
+const (
+	notificationActionComment = "comment"
+	notificationActionIgnore  = "ignore"
+)
+
+// notificationHandling configures how notifications of a type, like acknowledgements or downtimes, are handled
+// instead of applying the mappings. Only open tickets are updated, notifications of events without open ticket
+// are ignored.
+type notificationHandling struct {
+	// Action is "comment" to add the author and text of the notification to the ticket or "ignore".
+	Action string
+	// Status is set on the ticket after commenting if not empty, e.g. "stalled" for downtimes.
+	Status string `json:",omitempty"`
+	// AssignAuthor sets the ticket owner to the author of the notification after commenting.
+	AssignAuthor bool `json:",omitempty"`
+}
+
+// checkNotifications validates the notification types and actions of notification handlings.
+func checkNotifications(handlings map[string]notificationHandling) error {
+	for k, v := range handlings {
+		if _, err := normalizeNotificationType(k); err != nil {
+			return err
+		}
+
+		switch v.Action {
+		case notificationActionComment:
+		case notificationActionIgnore:
+			if v.Status != "" || v.AssignAuthor {
+				return fmt.Errorf("Status and AssignAuthor can't be used with action %v of %v", v.Action, k)
+			}
+		default:
+			return fmt.Errorf("invalid action %v of %v", v.Action, k)
+		}
+	}
+
+	return nil
+}
+
+// notificationHandling returns the handling of the notification type of the event, if any.
+func (t *ticketUpdater) notificationHandling(e *event.Notification) (notificationHandling, bool) {
+	for k, v := range t.notifications {
+		if strings.EqualFold(k, string(e.NotificationType)) {
+			return v, true
+		}
+	}
+
+	return notificationHandling{}, false
+}
+
+func formatNotificationComment(e *event.Notification) string {
+	comment := string(e.NotificationType)
+
+	if e.Author != "" {
+		comment = fmt.Sprintf("%v by %v", comment, e.Author)
+	}
+
+	if e.Text != "" {
+		comment = fmt.Sprintf("%v: %v", comment, e.Text)
+	}
+
+	return comment
+}
+
+// handleNotification applies the handling h to the ticket of the event, if the ticket is open.
+func (t *ticketUpdater) handleNotification(e *event.Notification, h notificationHandling, ticketID int, open bool) error {
+	if !open || h.Action == notificationActionIgnore {
+		if *debug {
+			log.Printf("%x ticket updater: ignoring %v notification", eventID(e), e.NotificationType)
+		}
+		return nil
+	}
+
+	if err := t.rtClient.CommentTicket(ticketID, formatNotificationComment(e)); err != nil {
+		return err
+	}
+
+	changes := &rt.Ticket{ID: ticketID, Status: h.Status}
+	if h.AssignAuthor {
+		changes.Owner = e.Author
+	}
+
+	if changes.Status != "" || changes.Owner != "" {
+		if _, err := t.rtClient.UpdateTicket(changes); err != nil {
+			return err
+		}
+	}
+
+	if *debug {
+		log.Printf("%x ticket updater: handled %v notification on ticket #%v", eventID(e), e.NotificationType, ticketID)
+	}
+
+	return t.cache.updateEventTicket(e, ticketID)
+}
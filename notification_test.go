@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func newTestNotification(host, service string, state event.State, typ event.NotificationType, author, text string) *event.Notification {
+	e := newTestEvent(host, service, state)
+	e.NotificationType = typ
+	e.Author = author
+	e.Text = text
+	return e
+}
+
+func TestTicketUpdaterNotifications(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+	tu.notifications = map[string]notificationHandling{
+		"ACKNOWLEDGEMENT": {Action: notificationActionComment, AssignAuthor: true},
+		"downtimestart":   {Action: notificationActionComment, Status: "stalled"},
+		"DOWNTIMEEND":     {Action: notificationActionComment, Status: "open"},
+		"FLAPPINGSTART":   {Action: notificationActionIgnore},
+	}
+
+	steps := []struct {
+		Event   *event.Notification
+		Tickets int    // number of tickets created after processing
+		Status  string // status of the ticket after processing
+		Owner   string // owner of the ticket after processing
+	}{
+		// no ticket, nothing to handle
+		{Event: newTestNotification("example.com", "example", event.StateCritical, event.NotificationDowntimeStart, "jdoe", ""), Tickets: 0},
+		{Event: newTestNotification("example.com", "example", event.StateCritical, event.NotificationProblem, "", ""), Tickets: 1},
+		{Event: newTestNotification("example.com", "example", event.StateCritical, event.NotificationAcknowledgement, "jdoe", "working on it"), Tickets: 1, Owner: "jdoe"},
+		{Event: newTestNotification("example.com", "example", event.StateCritical, event.NotificationDowntimeStart, "jdoe", "maintenance"), Tickets: 1, Status: "stalled", Owner: "jdoe"},
+		{Event: newTestNotification("example.com", "example", event.StateCritical, event.NotificationFlappingStart, "", ""), Tickets: 1, Status: "stalled", Owner: "jdoe"},
+		{Event: newTestNotification("example.com", "example", event.StateCritical, event.NotificationDowntimeEnd, "", ""), Tickets: 1, Status: "open", Owner: "jdoe"},
+	}
+
+	for i, v := range steps {
+		if err := tu.update(v.Event); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rt.tickets) != v.Tickets {
+			t.Fatalf("step %v: got %v tickets, expected %v", i, len(rt.tickets), v.Tickets)
+		}
+
+		if v.Tickets > 0 && (rt.tickets[0].Status != v.Status || rt.tickets[0].Owner != v.Owner) {
+			t.Errorf("step %v: got status %v and owner %v, expected %v and %v", i, rt.tickets[0].Status, rt.tickets[0].Owner, v.Status, v.Owner)
+		}
+	}
+
+	expected := []string{"ACKNOWLEDGEMENT by jdoe: working on it", "DOWNTIMESTART by jdoe: maintenance", "DOWNTIMEEND"}
+	if strings.Join(rt.comments[0], "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected comments: %v", rt.comments[0])
+	}
+}
+
+func TestCheckNotifications(t *testing.T) {
+	valid := map[string]notificationHandling{
+		"ACKNOWLEDGEMENT": {Action: notificationActionComment, AssignAuthor: true},
+		"FLAPPINGEND":     {Action: notificationActionIgnore},
+	}
+
+	if err := checkNotifications(valid); err != nil {
+		t.Error(err)
+	}
+
+	for _, v := range []map[string]notificationHandling{
+		{"BROKEN": {Action: notificationActionComment}},
+		{"ACKNOWLEDGEMENT": {Action: "delete"}},
+		{"DOWNTIMESTART": {Action: notificationActionIgnore, Status: "stalled"}},
+	} {
+		if err := checkNotifications(v); err == nil {
+			t.Errorf("expected error for %+v", v)
+		}
+	}
+}
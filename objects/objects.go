@@ -0,0 +1,160 @@
+// Package objects is a minimal client for the Icinga2 objects API.
+package objects
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+const icingaAPI = "v1"
+
+// requestTimeout limits the time of a request including reading the response, so an unresponsive API doesn't block
+// the caller.
+const requestTimeout = 30 * time.Second
+
+// ErrNotFound is returned if the requested object doesn't exist.
+var ErrNotFound = errors.New("object doesn't exist")
+
+// Host attributes used by icinga2rt.
+type Host struct {
+	Name   string
+	Groups []string
+	Vars   map[string]interface{}
+}
+
+// result of an objects API query.
+type result struct {
+	Name  string
+	Type  string
+	Attrs json.RawMessage
+}
+
+// Client is a Icinga2 objects API client.
+type Client struct {
+	url                *url.URL
+	user               string
+	password           string
+	insecureSkipVerify bool
+}
+
+// NewClient prepares a Client for usage.
+//
+// The icingaURL should contain the path up to the API-version part, like the URL used for the event stream.
+func NewClient(icingaURL string, user, password string, insecureSkipVerify bool) (*Client, error) {
+	x, err := url.Parse(icingaURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{url: x, user: user, password: password, insecureSkipVerify: insecureSkipVerify}, nil
+}
+
+// object queries a single object of type typ (the plural used in the API path, e.g. "hosts") by name and decodes its
+// attributes into attrs.
+func (c *Client) object(typ string, name string, attrs interface{}, fields ...string) error {
+	x := http.Client{Timeout: requestTimeout, Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: c.insecureSkipVerify}}}
+
+	query := url.Values{}
+	for _, v := range fields {
+		query.Add("attrs", v)
+	}
+
+	u := url.URL{Scheme: "https", Host: c.url.Host, Path: filepath.Join(c.url.Path, icingaAPI, "objects", typ, name), RawQuery: query.Encode()}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(c.user, c.password)
+	req.Header.Add("Accept", "application/json")
+
+	res, err := x.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return fmt.Errorf("objects API returned: %v", res.Status)
+	}
+
+	var body struct {
+		Results []result
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return err
+	}
+
+	if len(body.Results) == 0 {
+		return ErrNotFound
+	}
+
+	return json.Unmarshal(body.Results[0].Attrs, attrs)
+}
+
+// Host returns the host with the given name.
+func (c *Client) Host(name string) (*Host, error) {
+	var attrs struct {
+		Groups []string
+		Vars   map[string]interface{}
+	}
+
+	err := c.object("hosts", name, &attrs, "groups", "vars")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Host{Name: name, Groups: attrs.Groups, Vars: attrs.Vars}, nil
+}
+
+// User attributes used by icinga2rt.
+type User struct {
+	Name  string
+	Email string
+}
+
+// User returns the user with the given name.
+func (c *Client) User(name string) (*User, error) {
+	var attrs struct {
+		Email string
+	}
+
+	err := c.object("users", name, &attrs, "email")
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{Name: name, Email: attrs.Email}, nil
+}
+
+// Service attributes used by icinga2rt.
+type Service struct {
+	Host string
+	Name string
+}
+
+// Service returns the service with the given name of the host.
+func (c *Client) Service(host string, name string) (*Service, error) {
+	var attrs struct {
+		HostName string `json:"host_name"`
+	}
+
+	err := c.object("services", host+"!"+name, &attrs, "host_name")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Service{Host: host, Name: name}, nil
+}
@@ -0,0 +1,107 @@
+package objects
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testUserResponse = `{"results":[{"attrs":{"email":"jdoe@example.com"},"joins":{},"meta":{},"name":"jdoe","type":"User"}]}`
+
+const testServiceResponse = `{"results":[{"attrs":{"host_name":"web01"},"joins":{},"meta":{},"name":"web01!http","type":"Service"}]}`
+
+const testHostResponse = `{"results":[{"attrs":{"groups":["linux","web"],"vars":{"customer":"acme","os":"Linux"}},"joins":{},"meta":{},"name":"web01","type":"Host"}]}`
+
+func testServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "root" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/objects/hosts/web01":
+			fmt.Fprint(w, testHostResponse)
+		case "/v1/objects/services/web01!http":
+			fmt.Fprint(w, testServiceResponse)
+		case "/v1/objects/users/jdoe":
+			fmt.Fprint(w, testUserResponse)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestHost(t *testing.T) {
+	s := testServer()
+	defer s.Close()
+
+	c, err := NewClient(s.URL, "root", "secret", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := c.Host("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Name != "web01" || len(h.Groups) != 2 || h.Vars["customer"] != "acme" {
+		t.Errorf("unexpected host: %+v", h)
+	}
+
+	_, err = c.Host("web02")
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got: %v", err)
+	}
+}
+
+func TestUser(t *testing.T) {
+	s := testServer()
+	defer s.Close()
+
+	c, err := NewClient(s.URL, "root", "secret", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := c.User("jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Name != "jdoe" || u.Email != "jdoe@example.com" {
+		t.Errorf("unexpected user: %+v", u)
+	}
+
+	_, err = c.User("unknown")
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got: %v", err)
+	}
+}
+
+func TestService(t *testing.T) {
+	s := testServer()
+	defer s.Close()
+
+	c, err := NewClient(s.URL, "root", "secret", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := c.Service("web01", "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if x.Host != "web01" || x.Name != "http" {
+		t.Errorf("unexpected service: %+v", x)
+	}
+
+	_, err = c.Service("web01", "ssh")
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got: %v", err)
+	}
+}
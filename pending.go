@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+// minPendingRetry is the minimum delay before a failed pending creation is retried.
+const minPendingRetry = time.Minute
+
+// recovered returns true if the event recovered, so a pending creation is canceled. Hosts are up in the states OK
+// and WARNING, like in host mappings. Groups recover when all members recovered.
+func recovered(e *event.Notification) bool {
+	if !isGroupEvent(e) && hostState(e) == hostStateUp {
+		return true
+	}
+
+	return e.CheckResult.State == event.StateOK
+}
+
+// delayedCreate schedules the creation of a ticket after the create delay. The creation is canceled if the event
+// recovers before. If a creation is already pending for the event, the event is updated but the creation isn't
+// delayed further.
+func (t *ticketUpdater) delayedCreate(e *event.Notification) error {
+	p, err := t.cache.getPending(e)
+	if err != nil {
+		return err
+	}
+
+	if p == nil {
+		p = &pendingEvent{Due: time.Now().Add(t.createDelay)}
+	}
+
+	p.Event = e
+
+	if err := t.cache.putPending(p); err != nil {
+		return err
+	}
+
+	if *debug {
+		log.Printf("%x ticket updater: ticket creation pending until %v", eventID(e), p.Due)
+	}
+
+	t.schedule(p)
+
+	return nil
+}
+
+// schedule starts a timer creating the ticket of the pending event when it is due, if none is running already.
+func (t *ticketUpdater) schedule(p *pendingEvent) {
+	id := string(t.cache.key(p.Event))
+	if _, ok := t.timers[id]; ok {
+		return
+	}
+
+	e := p.Event
+	t.timers[id] = time.AfterFunc(time.Until(p.Due), func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		delete(t.timers, id)
+
+		if err := t.createPending(e); err != nil {
+			d := t.createDelay
+			if d < minPendingRetry {
+				d = minPendingRetry
+			}
+
+			log.Printf("ticket updater: couldn't create pending ticket for %v, retrying in %v: %v", formatEventSubject(e), d, err)
+			t.schedule(&pendingEvent{Event: e, Due: time.Now().Add(d)})
+		}
+	})
+}
+
+// createPending creates the ticket for a pending event, if it wasn't canceled in the meantime.
+func (t *ticketUpdater) createPending(e *event.Notification) error {
+	p, err := t.cache.getPending(e)
+	if err != nil {
+		return err
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	if p.Members != nil {
+		t.member = failingMember(p.Members)
+	}
+
+	err = t.create(p.Event)
+	t.member = nil
+	if err != nil {
+		return err
+	}
+
+	if p.Members != nil {
+		entry, err := t.cache.getEntry(p.Event)
+		if err != nil {
+			return err
+		}
+
+		// the creation was suppressed by an alert storm, which tracks the group instead.
+		if entry == nil {
+			if *debug {
+				log.Printf("%x ticket updater: dropped members of pending group during alert storm", eventID(p.Event))
+			}
+			return t.cache.deletePending(p.Event)
+		}
+
+		entry.Members = p.Members
+		if err := t.cache.putEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	return t.cache.deletePending(p.Event)
+}
+
+// cancelPending cancels the pending creation for the event. It returns true if a creation was pending.
+func (t *ticketUpdater) cancelPending(e *event.Notification) (bool, error) {
+	p, err := t.cache.getPending(e)
+	if err != nil || p == nil {
+		return false, err
+	}
+
+	id := string(t.cache.key(e))
+	if timer, ok := t.timers[id]; ok {
+		timer.Stop()
+		delete(t.timers, id)
+	}
+
+	if *debug {
+		log.Printf("%x ticket updater: canceled pending ticket creation", eventID(e))
+	}
+
+	return true, t.cache.deletePending(e)
+}
+
+// restorePending starts the timers of all pending creations saved in the cache, e.g. after a restart.
+// Creations which became due while not running are done immediately.
+func (t *ticketUpdater) restorePending() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ps, err := t.cache.allPending()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range ps {
+		if *debug {
+			log.Printf("%x ticket updater: restoring pending ticket creation due at %v", eventID(p.Event), p.Due)
+		}
+
+		t.schedule(p)
+	}
+
+	return nil
+}
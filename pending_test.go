@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func delayedTicketUpdater(t *testing.T, delay time.Duration) (*ticketUpdater, *DummyRT, func()) {
+	testMappings, err := readMappings(strings.NewReader(strings.Replace(testMappingsCSV, ",create", ",delayedcreate", -1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+	tu.createDelay = delay
+
+	return tu, rt, func() { removeCache(cache, cachePath) }
+}
+
+// waitTickets waits until n tickets are created, or a second has passed.
+func waitTickets(tu *ticketUpdater, rt *DummyRT, n int) bool {
+	for i := 0; i < 100; i++ {
+		tu.mu.Lock()
+		created := len(rt.tickets)
+		tu.mu.Unlock()
+
+		if created == n {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestDelayedCreate(t *testing.T) {
+	tu, rt, cleanup := delayedTicketUpdater(t, 50*time.Millisecond)
+	defer cleanup()
+
+	e := newTestEvent("example.com", "example", event.StateWarning)
+	if err := tu.update(e); err != nil {
+		t.Fatal(err)
+	}
+
+	tu.mu.Lock()
+	if len(rt.tickets) != 0 {
+		t.Error("ticket created before grace period passed")
+	}
+	tu.mu.Unlock()
+
+	if err := tu.update(newTestEvent("example.com", "example", event.StateCritical)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitTickets(tu, rt, 1) {
+		t.Fatal("ticket wasn't created after grace period")
+	}
+
+	tu.mu.Lock()
+	defer tu.mu.Unlock()
+
+	_, ticketID, err := tu.cache.getEventTicket(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ticketID != 0 || rt.tickets[0].Subject != formatEventSubject(newTestEvent("example.com", "example", event.StateCritical)) {
+		t.Errorf("unexpected ticket #%v: %+v", ticketID, rt.tickets[0])
+	}
+
+	p, err := tu.cache.getPending(e)
+	if err != nil || p != nil {
+		t.Errorf("pending creation wasn't removed: %+v %v", p, err)
+	}
+}
+
+func TestDelayedCreateCanceled(t *testing.T) {
+	tu, rt, cleanup := delayedTicketUpdater(t, time.Hour)
+	defer cleanup()
+
+	tu.audit = newAudit(auditConfig{})
+
+	for _, v := range []*event.Notification{
+		newTestEvent("example.com", "example", event.StateWarning),
+		newTestEvent("example.com", "example", event.StateOK),
+	} {
+		if err := tu.update(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(rt.tickets) != 0 || len(tu.timers) != 0 {
+		t.Errorf("creation wasn't canceled: %v tickets, %v timers", len(rt.tickets), len(tu.timers))
+	}
+
+	p, err := tu.cache.getPending(newTestEvent("example.com", "example", event.StateOK))
+	if err != nil || p != nil {
+		t.Errorf("pending creation wasn't removed: %+v %v", p, err)
+	}
+
+	as, err := tu.cache.getAudit(newTestEvent("example.com", "example", event.StateOK))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(as) != 2 || as[1].Action != "cancel delayed creation" {
+		t.Errorf("cancel wasn't audited: %+v", as)
+	}
+}
+
+func TestDelayedCreateHostRecovered(t *testing.T) {
+	tu, rt, cleanup := delayedTicketUpdater(t, time.Hour)
+	defer cleanup()
+
+	// WARNING is UP for hosts.
+	for _, v := range []*event.Notification{
+		newTestEvent("example.com", "", event.StateCritical),
+		newTestEvent("example.com", "", event.StateWarning),
+	} {
+		if err := tu.update(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(rt.tickets) != 0 || len(tu.timers) != 0 {
+		t.Errorf("creation wasn't canceled: %v tickets, %v timers", len(rt.tickets), len(tu.timers))
+	}
+
+	p, err := tu.cache.getPending(newTestEvent("example.com", "", event.StateWarning))
+	if err != nil || p != nil {
+		t.Errorf("pending creation wasn't removed: %+v %v", p, err)
+	}
+}
+
+func TestRestorePending(t *testing.T) {
+	tu, rt, cleanup := delayedTicketUpdater(t, time.Hour)
+	defer cleanup()
+
+	err := tu.cache.putPending(&pendingEvent{Event: newTestEvent("example.com", "example", event.StateCritical), Due: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tu.restorePending(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitTickets(tu, rt, 1) {
+		t.Fatal("restored ticket creation wasn't done")
+	}
+}
+
+func TestDelayedCreateGroupStorm(t *testing.T) {
+	tu, rt, cleanup := delayedTicketUpdater(t, 10*time.Millisecond)
+	defer cleanup()
+
+	tu.grouping = "var:customer"
+	tu.objects = testObjects
+	// every creation is suppressed by the storm.
+	tu.storm = newStorm(0, time.Minute, "storm")
+
+	e := newTestEvent("web01", "http", event.StateCritical)
+	if err := tu.update(e); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitTickets(tu, rt, 1) {
+		t.Fatal("storm ticket wasn't created after grace period")
+	}
+
+	tu.mu.Lock()
+	defer tu.mu.Unlock()
+
+	tu.storm.timer.Stop()
+
+	p, err := tu.cache.getPending(newGroupEvent("acme"))
+	if err != nil || p != nil {
+		t.Errorf("pending creation wasn't removed: %+v %v", p, err)
+	}
+
+	if rt.tickets[0].Queue != "storm" {
+		t.Errorf("expected the storm ticket, got %+v", rt.tickets[0])
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+// recordVersion is the version of the JSON records saved in the cache. Older versions of icinga2rt saved records
+// with encoding/gob, which are still decoded.
+const recordVersion = 1
+
+// maxHistory is the number of actions kept in the history of an entry.
+const maxHistory = 10
+
+// historyEntry is an action applied to the ticket of an entry.
+type historyEntry struct {
+	Time   time.Time `json:"time"`
+	State  string    `json:"state"`
+	Action string    `json:"action"`
+}
+
+// eventRecord are the properties of an event saved in the cache.
+type eventRecord struct {
+	Host             string    `json:"host"`
+	Group            bool      `json:"group,omitempty"`
+	Service          string    `json:"service,omitempty"`
+	State            string    `json:"state"`
+	Reachable        bool      `json:"reachable,omitempty"`
+	Output           string    `json:"output,omitempty"`
+	NotificationType string    `json:"notificationType,omitempty"`
+	Users            []string  `json:"users,omitempty"`
+	LastNotification time.Time `json:"lastNotification"`
+}
+
+func newEventRecord(e *event.Notification) eventRecord {
+	r := eventRecord{
+		Host:             e.Host,
+		Group:            isGroupEvent(e),
+		Service:          e.Service,
+		State:            e.CheckResult.State.String(),
+		Reachable:        e.CheckResult.VarsAfter.Reachable,
+		Output:           e.CheckResult.Output,
+		NotificationType: string(e.NotificationType),
+		Users:            e.Users,
+	}
+
+	if e.Timestamp != 0 {
+		r.LastNotification = time.Unix(0, int64(e.Timestamp*float64(time.Second))).UTC()
+	}
+
+	return r
+}
+
+func (r eventRecord) event() *event.Notification {
+	e := &event.Notification{
+		Host:             r.Host,
+		Service:          r.Service,
+		NotificationType: event.NotificationType(r.NotificationType),
+		Users:            r.Users,
+		CheckResult: event.CheckResultData{
+			State:     event.NewState(r.State),
+			Output:    r.Output,
+			VarsAfter: event.CheckResultVars{Reachable: r.Reachable},
+		},
+	}
+
+	if r.Group {
+		e.Type = streamTypeGroup
+	}
+
+	if !r.LastNotification.IsZero() {
+		e.Timestamp = float64(r.LastNotification.UnixNano()) / float64(time.Second)
+	}
+
+	return e
+}
+
+func encodeMembers(members map[string]event.State) map[string]string {
+	if members == nil {
+		return nil
+	}
+
+	x := make(map[string]string, len(members))
+	for k, v := range members {
+		x[k] = v.String()
+	}
+
+	return x
+}
+
+func decodeMembers(members map[string]string) map[string]event.State {
+	if members == nil {
+		return nil
+	}
+
+	x := make(map[string]event.State, len(members))
+	for k, v := range members {
+		x[k] = event.NewState(v)
+	}
+
+	return x
+}
+
+// ticketRecord is the record of an eventTicket.
+type ticketRecord struct {
+	Version      int               `json:"version"`
+	Event        eventRecord       `json:"event"`
+	TicketID     int               `json:"ticketId"`
+	TicketStatus string            `json:"ticketStatus,omitempty"`
+	Folded       bool              `json:"folded,omitempty"`
+	Members      map[string]string `json:"members,omitempty"`
+	Resolved     time.Time         `json:"resolved"`
+	Created      time.Time         `json:"created"`
+	Escalated    []int             `json:"escalated,omitempty"`
+	History      []historyEntry    `json:"history,omitempty"`
+}
+
+// pendingRecord is the record of a pendingEvent.
+type pendingRecord struct {
+	Version int               `json:"version"`
+	Event   eventRecord       `json:"event"`
+	Members map[string]string `json:"members,omitempty"`
+	Due     time.Time         `json:"due"`
+}
+
+// isRecord returns true if x is a JSON record, otherwise it is gob encoded by an older version.
+func isRecord(x []byte) bool {
+	return json.Valid(x)
+}
+
+func checkRecordVersion(version int) error {
+	if version != recordVersion {
+		return fmt.Errorf("unknown record version %v", version)
+	}
+
+	return nil
+}
+
+func newTicketRecord(et *eventTicket) ticketRecord {
+	return ticketRecord{
+		Version:      recordVersion,
+		Event:        newEventRecord(et.Event),
+		TicketID:     et.TicketID,
+		TicketStatus: et.TicketStatus,
+		Folded:       et.Folded,
+		Members:      encodeMembers(et.Members),
+		Resolved:     et.Resolved,
+		Created:      et.Created,
+		Escalated:    et.Escalated,
+		History:      et.History,
+	}
+}
+
+func marshalTicketRecord(et *eventTicket) ([]byte, error) {
+	return json.Marshal(newTicketRecord(et))
+}
+
+func unmarshalTicketRecord(x []byte) (*eventTicket, error) {
+	var r ticketRecord
+	if err := json.Unmarshal(x, &r); err != nil {
+		return nil, err
+	}
+
+	if err := checkRecordVersion(r.Version); err != nil {
+		return nil, err
+	}
+
+	return &eventTicket{
+		Event:        r.Event.event(),
+		TicketID:     r.TicketID,
+		TicketStatus: r.TicketStatus,
+		Folded:       r.Folded,
+		Members:      decodeMembers(r.Members),
+		Resolved:     r.Resolved,
+		Created:      r.Created,
+		Escalated:    r.Escalated,
+		History:      r.History,
+	}, nil
+}
+
+func marshalPendingRecord(p *pendingEvent) ([]byte, error) {
+	return json.Marshal(pendingRecord{
+		Version: recordVersion,
+		Event:   newEventRecord(p.Event),
+		Members: encodeMembers(p.Members),
+		Due:     p.Due,
+	})
+}
+
+func unmarshalPendingRecord(x []byte) (*pendingEvent, error) {
+	var r pendingRecord
+	if err := json.Unmarshal(x, &r); err != nil {
+		return nil, err
+	}
+
+	if err := checkRecordVersion(r.Version); err != nil {
+		return nil, err
+	}
+
+	return &pendingEvent{Event: r.Event.event(), Members: decodeMembers(r.Members), Due: r.Due}, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func TestTicketRecord(t *testing.T) {
+	e := newTestEvent("example.com", "example", event.StateCritical)
+	e.CheckResult.Output = "CRITICAL - disk full"
+	e.Timestamp = 1500000000.5
+
+	created := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	et := &eventTicket{
+		Event:        e,
+		TicketID:     1234,
+		TicketStatus: "open",
+		Created:      created,
+		Escalated:    []int{0},
+		History:      []historyEntry{{Time: created, State: "CRITICAL", Action: "create"}},
+	}
+
+	x, err := encodeEventTicket(et)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r map[string]interface{}
+	if err := json.Unmarshal(x, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r["version"] != float64(recordVersion) {
+		t.Errorf("record has no version: %s", x)
+	}
+
+	y, err := decodeEventTicket(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if y.Event.Host != e.Host || y.Event.Service != e.Service || y.Event.CheckResult.State != event.StateCritical ||
+		y.Event.CheckResult.Output != e.CheckResult.Output || !y.Event.CheckResult.VarsAfter.Reachable ||
+		y.Event.Timestamp != e.Timestamp {
+		t.Errorf("event wasn't decoded: %+v", y.Event)
+	}
+
+	if y.TicketID != 1234 || y.TicketStatus != "open" || !y.Created.Equal(created) || len(y.Escalated) != 1 ||
+		len(y.History) != 1 || y.History[0].Action != "create" {
+		t.Errorf("entry wasn't decoded: %+v", y)
+	}
+}
+
+func TestPendingRecord(t *testing.T) {
+	due := time.Date(2017, 7, 14, 2, 45, 0, 0, time.UTC)
+	e := &event.Notification{Host: "example.com", CheckResult: event.CheckResultData{State: event.StateWarning}, Users: []string{"jdoe"}}
+	p := &pendingEvent{Event: e, Members: map[string]event.State{"example": event.StateWarning}, Due: due}
+
+	x, err := encodePendingEvent(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	y, err := decodePendingEvent(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if y.Event.Host != e.Host || len(y.Event.Users) != 1 || y.Members["example"] != event.StateWarning || !y.Due.Equal(due) {
+		t.Errorf("pending event wasn't decoded: %+v", y)
+	}
+}
+
+func TestRecordVersion(t *testing.T) {
+	_, err := decodeEventTicket([]byte(`{"version":2,"event":{"host":"example.com"},"ticketId":1}`))
+	if err == nil || !strings.Contains(err.Error(), "unknown record version 2") {
+		t.Errorf("expected error for unknown version, got: %v", err)
+	}
+}
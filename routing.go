@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/filter"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+// routingRule sets properties of new tickets for events matching Filter and States.
+//
+// Filter is evaluated using filter.Filter.All, so every field set must match.
+// An empty States list matches every state. Empty ticket properties aren't changed.
+type routingRule struct {
+	Filter     filter.Filter
+	States     []string `json:",omitempty"`
+	Queue      string   `json:",omitempty"`
+	Owner      string   `json:",omitempty"`
+	Priority   string   `json:",omitempty"`
+	Requestors []string `json:",omitempty"`
+	Cc         []string `json:",omitempty"`
+}
+
+// match returns true if the event matches the filter and states of the rule.
+func (r routingRule) match(e *event.Notification) bool {
+	if !r.Filter.All(*e) {
+		return false
+	}
+
+	if len(r.States) == 0 {
+		return true
+	}
+
+	for _, v := range r.States {
+		if strings.ToUpper(v) == e.CheckResult.State.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply sets the properties of the rule on the ticket.
+func (r routingRule) apply(ticket *rt.Ticket) {
+	if r.Queue != "" {
+		ticket.Queue = r.Queue
+	}
+
+	if r.Owner != "" {
+		ticket.Owner = r.Owner
+	}
+
+	if r.Priority != "" {
+		ticket.Priority = r.Priority
+	}
+
+	if len(r.Requestors) != 0 {
+		ticket.Requestors = strings.Join(r.Requestors, ", ")
+	}
+
+	if len(r.Cc) != 0 {
+		ticket.Cc = strings.Join(r.Cc, ", ")
+	}
+}
+
+// checkRouting validates the states used in routing rules.
+func checkRouting(rules []routingRule) error {
+	for i, r := range rules {
+		for _, v := range r.States {
+			if event.NewState(strings.ToUpper(v)) == event.StateNil {
+				return fmt.Errorf("invalid state value %v in routing rule %v", v, i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// route applies the first routing rule matching the event to the ticket.
+// The ticket is left untouched if no rule matches.
+func route(rules []routingRule, e *event.Notification, ticket *rt.Ticket) {
+	for i, r := range rules {
+		if r.match(e) {
+			if *debug {
+				log.Printf("%x ticket updater: matched routing rule %v", eventID(e), i)
+			}
+
+			r.apply(ticket)
+			return
+		}
+	}
+}
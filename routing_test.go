@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/filter"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+var testRouting = []routingRule{
+	{
+		Filter:   filter.Filter{Host: "db.example.com"},
+		States:   []string{"critical"},
+		Queue:    "dba",
+		Priority: "90",
+		Cc:       []string{"dba@example.com", "oncall@example.com"},
+	},
+	{
+		Filter: filter.Filter{Host: "db.example.com"},
+		Queue:  "dba",
+	},
+	{
+		Filter:     filter.Filter{Users: []string{"customer"}},
+		Queue:      "customer",
+		Owner:      "support",
+		Requestors: []string{"customer@example.com"},
+	},
+}
+
+var routingTests = []struct {
+	Event  *event.Notification
+	Ticket rt.Ticket
+}{
+	{
+		Event:  &event.Notification{Host: "db.example.com", CheckResult: event.CheckResultData{State: event.StateCritical}},
+		Ticket: rt.Ticket{Queue: "dba", Priority: "90", Cc: "dba@example.com, oncall@example.com"},
+	},
+	{
+		Event:  &event.Notification{Host: "db.example.com", CheckResult: event.CheckResultData{State: event.StateWarning}},
+		Ticket: rt.Ticket{Queue: "dba"},
+	},
+	{
+		Event:  &event.Notification{Host: "www.example.com", Users: []string{"customer"}},
+		Ticket: rt.Ticket{Queue: "customer", Owner: "support", Requestors: "customer@example.com"},
+	},
+	{
+		Event:  &event.Notification{Host: "www.example.com", Users: []string{"admin"}},
+		Ticket: rt.Ticket{Queue: "general"},
+	},
+}
+
+func TestRoute(t *testing.T) {
+	if err := checkRouting(testRouting); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range routingTests {
+		ticket := rt.Ticket{Queue: "general"}
+		route(testRouting, v.Event, &ticket)
+
+		if ticket != v.Ticket {
+			t.Logf("got: %+v expected: %+v", ticket, v.Ticket)
+			t.Fail()
+		}
+	}
+}
+
+func TestCheckRouting(t *testing.T) {
+	err := checkRouting([]routingRule{{States: []string{"broken"}}})
+	if err == nil {
+		t.Fail()
+	}
+}
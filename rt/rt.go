@@ -3,6 +3,7 @@ package rt
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +13,9 @@ import (
 	"strings"
 )
 
+// ErrNotFound is returned if the requested ticket doesn't exist.
+var ErrNotFound = errors.New("ticket doesn't exist")
+
 type Ticket struct {
 	ID              int
 	Queue           string
@@ -44,7 +48,7 @@ func (t *Ticket) decode(r io.Reader) error {
 
 	for s.Scan() {
 		if strings.HasPrefix(s.Text(), "# Ticket ") {
-			return fmt.Errorf("ticket doesn't exist")
+			return ErrNotFound
 		}
 
 		if !strings.Contains(s.Text(), ": ") {
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ruleNegation is the prefix of excluded values in rules.
+const ruleNegation = "!"
+
+// rule is a mapping read from a rules file. Conditions which aren't set match any value.
+type rule struct {
+	Name string        `json:"name,omitempty" yaml:"name,omitempty"`
+	When ruleCondition `json:"when" yaml:"when"`
+	Then []ruleAction  `json:"then" yaml:"then"`
+}
+
+type ruleCondition struct {
+	State            ruleValues `json:"state,omitempty" yaml:"state,omitempty"`
+	OldState         ruleValues `json:"oldState,omitempty" yaml:"oldState,omitempty"`
+	Owned            ruleValues `json:"owned,omitempty" yaml:"owned,omitempty"`
+	NotificationType ruleValues `json:"notificationType,omitempty" yaml:"notificationType,omitempty"`
+	ObjectType       ruleValues `json:"objectType,omitempty" yaml:"objectType,omitempty"`
+	TicketStatus     ruleValues `json:"ticketStatus,omitempty" yaml:"ticketStatus,omitempty"`
+	Queue            ruleValues `json:"queue,omitempty" yaml:"queue,omitempty"`
+	Schedule         ruleValues `json:"schedule,omitempty" yaml:"schedule,omitempty"`
+}
+
+// ruleAction is an action with its parameters. Only the parameter of the action may be set.
+type ruleAction struct {
+	Action   string `json:"action" yaml:"action"`
+	Status   string `json:"status,omitempty" yaml:"status,omitempty"`
+	Priority *int   `json:"priority,omitempty" yaml:"priority,omitempty"`
+	User     string `json:"user,omitempty" yaml:"user,omitempty"`
+}
+
+// ruleValues are the values of a condition. They can be given as a single value or a list of values.
+// Values prefixed with "!" are excluded, "*" matches any value.
+type ruleValues []string
+
+func (v *ruleValues) set(x interface{}) error {
+	switch x := x.(type) {
+	case nil:
+		*v = nil
+	case string:
+		*v = ruleValues{x}
+	case bool:
+		*v = ruleValues{strconv.FormatBool(x)}
+	case []interface{}:
+		vs := make(ruleValues, 0, len(x))
+		for _, y := range x {
+			switch y := y.(type) {
+			case string:
+				vs = append(vs, y)
+			case bool:
+				vs = append(vs, strconv.FormatBool(y))
+			default:
+				return fmt.Errorf("invalid value %v", y)
+			}
+		}
+		*v = vs
+	default:
+		return fmt.Errorf("invalid value %v", x)
+	}
+
+	return nil
+}
+
+func (v *ruleValues) UnmarshalJSON(b []byte) error {
+	var x interface{}
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+
+	return v.set(x)
+}
+
+func (v *ruleValues) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var x interface{}
+	if err := unmarshal(&x); err != nil {
+		return err
+	}
+
+	return v.set(x)
+}
+
+// compile checks and normalizes the values using normalize.
+func (v ruleValues) compile(normalize func(string) (string, error)) (values, error) {
+	c := values{}
+	any := len(v) == 0
+
+	for _, x := range v {
+		if x == wildcard {
+			any = true
+			continue
+		}
+
+		exclude := strings.HasPrefix(x, ruleNegation)
+		if exclude {
+			x = strings.TrimPrefix(x, ruleNegation)
+		}
+
+		y, err := normalize(x)
+		if err != nil {
+			return anyValue, err
+		}
+
+		if exclude {
+			c.exclude = append(c.exclude, y)
+		} else {
+			c.include = append(c.include, y)
+		}
+	}
+
+	if any {
+		c.include = nil
+	}
+
+	return c, nil
+}
+
+func (c ruleCondition) compile() (condition, error) {
+	x := condition{}
+
+	fields := []struct {
+		name      string
+		values    ruleValues
+		normalize func(string) (string, error)
+		condition *values
+	}{
+		{"state", c.State, normalizeState, &x.state},
+		{"oldState", c.OldState, normalizeOldState, &x.oldState},
+		{"owned", c.Owned, normalizeOwned, &x.owned},
+		{"notificationType", c.NotificationType, normalizeNotificationType, &x.notificationType},
+		{"objectType", c.ObjectType, normalizeObjectType, &x.objectType},
+		{"ticketStatus", c.TicketStatus, normalizeString, &x.ticketStatus},
+		{"queue", c.Queue, normalizeString, &x.queue},
+		{"schedule", c.Schedule, normalizeString, &x.schedule},
+	}
+
+	for _, v := range fields {
+		vs, err := v.values.compile(v.normalize)
+		if err != nil {
+			return x, fmt.Errorf("%v: %v", v.name, err)
+		}
+
+		*v.condition = vs
+	}
+
+	return x, nil
+}
+
+func (a ruleAction) compile() (actionFunc, error) {
+	params := 0
+	if a.Status != "" {
+		params++
+	}
+	if a.Priority != nil {
+		params++
+	}
+	if a.User != "" {
+		params++
+	}
+
+	param := ""
+	switch strings.ToLower(a.Action) {
+	case actionStringSetStatus:
+		param = a.Status
+	case actionStringSetPriority:
+		if a.Priority != nil {
+			param = strconv.Itoa(*a.Priority)
+		}
+	case actionStringAssign:
+		param = a.User
+	}
+
+	if params > 1 || (params == 1 && param == "") {
+		return nil, fmt.Errorf("unexpected parameter in action %v", a.Action)
+	}
+
+	action, err := newAction(a.Action, param)
+	if err != nil {
+		return nil, fmt.Errorf("%v in action %v", err, a.Action)
+	}
+
+	return action, nil
+}
+
+func (r rule) compile() (mapping, error) {
+	c, err := r.When.compile()
+	if err != nil {
+		return mapping{}, err
+	}
+
+	if len(r.Then) == 0 {
+		return mapping{}, fmt.Errorf("missing action")
+	}
+
+	names := make([]string, 0, len(r.Then))
+	actions := make([]actionFunc, 0, len(r.Then))
+	for _, v := range r.Then {
+		action, err := v.compile()
+		if err != nil {
+			return mapping{}, err
+		}
+
+		names = append(names, v.Action)
+		actions = append(actions, action)
+	}
+
+	name := strings.Join(names, "+")
+
+	if len(actions) == 1 {
+		return mapping{condition: c, action: actions[0], name: name}, nil
+	}
+
+	return mapping{condition: c, action: actionChain(names, actions), name: name}, nil
+}
+
+// isYAMLRules returns true if the rules file is YAML by its extension, otherwise it's JSON.
+func isYAMLRules(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return true
+	default:
+		return false
+	}
+}
+
+func loadRules(filename string) ([]mapping, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ms, err := readRules(f, isYAMLRules(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	return withSource(ms, filename), nil
+}
+
+// readRules reads a list of rules from JSON or YAML and compiles them to mappings, keeping their order.
+func readRules(r io.Reader, isYAML bool) ([]mapping, error) {
+	var rules []rule
+
+	if isYAML {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := yaml.UnmarshalStrict(b, &rules); err != nil {
+			return nil, err
+		}
+	} else {
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+
+		if err := dec.Decode(&rules); err != nil {
+			return nil, err
+		}
+	}
+
+	ms := make([]mapping, 0, len(rules))
+	for i, v := range rules {
+		m, err := v.compile()
+		if err != nil {
+			if v.Name != "" {
+				return nil, fmt.Errorf("error in rule %v (%v): %v", i+1, v.Name, err)
+			}
+			return nil, fmt.Errorf("error in rule %v: %v", i+1, err)
+		}
+
+		m.source = fmt.Sprintf("rule %v", i+1)
+		if v.Name != "" {
+			m.source = fmt.Sprintf("rule %v (%v)", i+1, v.Name)
+		}
+
+		ms = append(ms, m)
+	}
+
+	return ms, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const validRulesYAML = `
+- name: acknowledgements
+  when:
+    notificationType: ACKNOWLEDGEMENT
+  then:
+    - action: comment
+- name: problems
+  when:
+    state: [WARNING, CRITICAL, UNKNOWN]
+    oldState: ""
+  then:
+    - action: create
+    - action: setpriority
+      priority: 50
+- when:
+    state: OK
+    oldState: "!OK"
+    owned: false
+    queue: ["*"]
+  then:
+    - action: resolve
+`
+
+const validRulesJSON = `[
+	{"when": {"state": "OK", "owned": true}, "then": [{"action": "assign", "user": "Nobody"}]},
+	{"when": {"ticketStatus": ["!stalled", "!deleted"]}, "then": [{"action": "setstatus", "status": "open"}]}
+]`
+
+var invalidRules = []string{
+	`[{"when": {"state": "BROKEN"}, "then": [{"action": "ignore"}]}]`,
+	`[{"when": {"state": "OK"}, "then": []}]`,
+	`[{"when": {"state": "OK"}, "then": [{"action": "ignore", "user": "Nobody"}]}]`,
+	`[{"when": {"state": "OK"}, "then": [{"action": "setstatus", "user": "Nobody"}]}]`,
+	`[{"when": {"stat": "OK"}, "then": [{"action": "ignore"}]}]`,
+	`[{"when": {"owned": 1}, "then": [{"action": "ignore"}]}]`,
+}
+
+func TestReadRules(t *testing.T) {
+	ms, err := readRules(strings.NewReader(validRulesYAML), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ms) != 3 {
+		t.Fatalf("expected 3 mappings, got %v", len(ms))
+	}
+
+	problem := facts{state: "CRITICAL", owned: "false", notificationType: "PROBLEM", objectType: "service"}
+	if ms[0].condition.match(problem) || !ms[1].condition.match(problem) {
+		t.Errorf("unexpected match of %+v", problem)
+	}
+
+	recovery := facts{state: "OK", oldState: "WARNING", owned: "false", queue: "general"}
+	if !ms[2].condition.match(recovery) {
+		t.Errorf("expected match of %+v", recovery)
+	}
+
+	recovery.oldState = "OK"
+	if ms[2].condition.match(recovery) {
+		t.Errorf("unexpected match of excluded value %+v", recovery)
+	}
+
+	ms, err = readRules(strings.NewReader(validRulesJSON), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 mappings, got %v", len(ms))
+	}
+
+	if ms[1].condition.match(facts{ticketStatus: "stalled"}) || !ms[1].condition.match(facts{ticketStatus: "new"}) {
+		t.Errorf("unexpected match of ticket status")
+	}
+
+	for _, v := range invalidRules {
+		_, err := readRules(strings.NewReader(v), false)
+		if err == nil {
+			t.Errorf("expected error while parsing invalid rules: %v", v)
+		}
+	}
+}
+
+func TestIsYAMLRules(t *testing.T) {
+	for k, v := range map[string]bool{
+		"/etc/bytemine/icinga2rt.yaml":  true,
+		"/etc/bytemine/icinga2rt.YML":   true,
+		"/etc/bytemine/icinga2rt.json":  false,
+		"/etc/bytemine/icinga2rt.rules": false,
+	} {
+		if isYAMLRules(k) != v {
+			t.Errorf("%v: expected %v", k, v)
+		}
+	}
+}
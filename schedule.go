@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// holidayLayout is the format of dates in holiday files.
+const holidayLayout = "2006-01-02"
+
+// scheduleConfig describes the times a schedule is active.
+type scheduleConfig struct {
+	// TimeZone of the ranges and holidays, like "Europe/Berlin". The local time zone is used if empty.
+	TimeZone string `json:",omitempty"`
+	// Ranges of weekdays and times, like "Mon-Fri 08:00-18:00" or "Sat 10:00-14:00".
+	Ranges []string
+	// Holidays is a file with dates (YYYY-MM-DD) the schedule isn't active, one per line, optional.
+	Holidays string `json:",omitempty"`
+}
+
+// mappingSet is a file of mappings or rules which are only applied while a schedule is active.
+type mappingSet struct {
+	// Schedule selecting the mapping set, or "!" followed by the schedule to select it while the schedule isn't active.
+	Schedule string
+	Mappings string `json:",omitempty"`
+	Rules    string `json:",omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeRange is a range of times on a set of weekdays.
+type timeRange struct {
+	days [7]bool
+	// start and end of the range as offset from midnight, end is excluded.
+	start time.Duration
+	end   time.Duration
+}
+
+func parseWeekday(x string) (time.Weekday, error) {
+	d, ok := weekdays[strings.ToLower(x)]
+	if !ok {
+		return 0, fmt.Errorf("invalid weekday %v", x)
+	}
+
+	return d, nil
+}
+
+// parseDays parses a comma separated list of weekdays and weekday ranges, like "Mon-Fri" or "Mon,Wed".
+func parseDays(x string) ([7]bool, error) {
+	days := [7]bool{}
+
+	for _, v := range strings.Split(x, ",") {
+		from, to := v, v
+		if i := strings.Index(v, "-"); i != -1 {
+			from, to = v[:i], v[i+1:]
+		}
+
+		start, err := parseWeekday(from)
+		if err != nil {
+			return days, err
+		}
+
+		end, err := parseWeekday(to)
+		if err != nil {
+			return days, err
+		}
+
+		// ranges may wrap around the end of the week, like "Sat-Sun".
+		for d := start; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == end {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseClock parses a time of day like "08:00", "24:00" is the end of the day.
+func parseClock(x string) (time.Duration, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(x, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %v", x)
+	}
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// parseTimeRange parses a range of weekdays and times like "Mon-Fri 08:00-18:00". Without times, like "Sat", the
+// range covers the whole days. Ranges can't cross midnight, they must be split into two ranges.
+func parseTimeRange(x string) (timeRange, error) {
+	r := timeRange{end: 24 * time.Hour}
+
+	fields := strings.Fields(x)
+	if len(fields) != 1 && len(fields) != 2 {
+		return r, fmt.Errorf("invalid range %v", x)
+	}
+
+	var err error
+	r.days, err = parseDays(fields[0])
+	if err != nil {
+		return r, err
+	}
+
+	if len(fields) == 1 {
+		return r, nil
+	}
+
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return r, fmt.Errorf("invalid times %v", fields[1])
+	}
+
+	r.start, err = parseClock(times[0])
+	if err != nil {
+		return r, err
+	}
+
+	r.end, err = parseClock(times[1])
+	if err != nil {
+		return r, err
+	}
+
+	if r.end <= r.start {
+		return r, fmt.Errorf("end of range %v must be after its start", x)
+	}
+
+	return r, nil
+}
+
+func (r timeRange) contains(t time.Time) bool {
+	if !r.days[t.Weekday()] {
+		return false
+	}
+
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	return offset >= r.start && offset < r.end
+}
+
+// readHolidays reads dates from a holiday file. Text after the date, like the name of the holiday, is ignored.
+// Lines can be commented if their first character is #.
+func readHolidays(filename string) (map[string]bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	holidays := make(map[string]bool)
+
+	s := bufio.NewScanner(f)
+	line := 0
+	for s.Scan() {
+		line++
+
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if _, err := time.Parse(holidayLayout, fields[0]); err != nil {
+			return nil, fmt.Errorf("error in line %v: invalid date %v", line, fields[0])
+		}
+
+		holidays[fields[0]] = true
+	}
+
+	return holidays, s.Err()
+}
+
+// schedule is active within its ranges, except on holidays.
+type schedule struct {
+	name     string
+	location *time.Location
+	ranges   []timeRange
+	holidays map[string]bool
+}
+
+func newSchedule(name string, c scheduleConfig) (*schedule, error) {
+	s := &schedule{name: name, location: time.Local, holidays: map[string]bool{}}
+
+	if c.TimeZone != "" {
+		var err error
+		s.location, err = time.LoadLocation(c.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.Ranges) == 0 {
+		return nil, fmt.Errorf("Ranges must be set")
+	}
+
+	for _, v := range c.Ranges {
+		r, err := parseTimeRange(v)
+		if err != nil {
+			return nil, err
+		}
+
+		s.ranges = append(s.ranges, r)
+	}
+
+	if c.Holidays != "" {
+		var err error
+		s.holidays, err = readHolidays(c.Holidays)
+		if err != nil {
+			return nil, fmt.Errorf("Holidays: %v", err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *schedule) active(t time.Time) bool {
+	t = t.In(s.location)
+
+	if s.holidays[t.Format(holidayLayout)] {
+		return false
+	}
+
+	for _, v := range s.ranges {
+		if v.contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// schedules evaluates a list of schedules at the current time.
+type schedules struct {
+	list []*schedule
+	now  func() time.Time
+}
+
+func newSchedules(list []*schedule) *schedules {
+	return &schedules{list: list, now: time.Now}
+}
+
+// active returns the names of all schedules active now.
+func (s *schedules) active() []string {
+	now := s.now()
+
+	names := []string{}
+	for _, v := range s.list {
+		if v.active(now) {
+			names = append(names, v.name)
+		}
+	}
+
+	return names
+}
+
+// scheduleValues returns the values of a schedule condition, "!" excludes the schedule.
+func scheduleValues(x string) values {
+	if strings.HasPrefix(x, ruleNegation) {
+		return values{exclude: []string{strings.TrimPrefix(x, ruleNegation)}}
+	}
+
+	return oneValue(x)
+}
+
+// loadMappingSet loads the mappings and rules of the set, which are only applied while the schedule is selected.
+// Rules are evaluated before mappings, like Ticket.Rules and Ticket.Mappings.
+func loadMappingSet(set mappingSet) ([]mapping, error) {
+	ms := []mapping{}
+
+	if set.Rules != "" {
+		rules, err := loadRules(set.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("Rules: %v", err)
+		}
+
+		ms = append(ms, rules...)
+	}
+
+	if set.Mappings != "" {
+		f, err := os.Open(set.Mappings)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		mappings, err := readMappings(f)
+		if err != nil {
+			return nil, fmt.Errorf("Mappings: %v", err)
+		}
+
+		ms = append(ms, withSource(mappings, set.Mappings)...)
+	}
+
+	// schedules set by rules take precedence.
+	for i := range ms {
+		if len(ms[i].condition.schedule.include) == 0 && len(ms[i].condition.schedule.exclude) == 0 {
+			ms[i].condition.schedule = scheduleValues(set.Schedule)
+		}
+	}
+
+	return ms, nil
+}
+
+// checkMappingSchedules returns an error if a mapping refers to a schedule which isn't configured.
+func checkMappingSchedules(ms []mapping, schedules map[string]scheduleConfig) error {
+	for _, m := range ms {
+		names := append(append([]string{}, m.condition.schedule.include...), m.condition.schedule.exclude...)
+
+		for _, name := range names {
+			if !knownSchedule(schedules, name) {
+				return fmt.Errorf("unknown schedule %v in %v", name, m.source)
+			}
+		}
+	}
+
+	return nil
+}
+
+// knownSchedule returns true if a schedule of the name is configured. Schedules are matched case insensitive.
+func knownSchedule(schedules map[string]scheduleConfig, name string) bool {
+	for k := range schedules {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+
+	return false
+}
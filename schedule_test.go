@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func TestParseTimeRange(t *testing.T) {
+	for _, v := range []string{"Mon-Fri 08:00-18:00", "Sat", "sat-sun 00:00-24:00", "Mon,Wed,Fri 10:30-12:00"} {
+		if _, err := parseTimeRange(v); err != nil {
+			t.Errorf("%v: %v", v, err)
+		}
+	}
+
+	for _, v := range []string{"", "Mon-Fry", "Mon 08:00", "Mon 18:00-08:00", "Mon 08:00-25:00", "Mon 08:00-18:00 extra"} {
+		if _, err := parseTimeRange(v); err == nil {
+			t.Errorf("expected error for range %v", v)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	f, err := os.CreateTemp("", "icinga2rt-holidays")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString("# holidays\n2018-10-03 Tag der Deutschen Einheit\n\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s, err := newSchedule("business", scheduleConfig{TimeZone: "Europe/Berlin", Ranges: []string{"Mon-Fri 08:00-18:00", "Sat 10:00-12:00"}, Holidays: f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Time   string
+		Active bool
+	}{
+		{Time: "2018-10-01T08:00:00+02:00", Active: true},  // Monday
+		{Time: "2018-10-01T06:00:00Z", Active: true},       // Monday 08:00 in Berlin
+		{Time: "2018-10-01T05:59:59Z", Active: false},      // Monday 07:59 in Berlin
+		{Time: "2018-10-01T18:00:00+02:00", Active: false}, // end is excluded
+		{Time: "2018-10-03T12:00:00+02:00", Active: false}, // holiday
+		{Time: "2018-10-06T11:00:00+02:00", Active: true},  // Saturday
+		{Time: "2018-10-07T11:00:00+02:00", Active: false}, // Sunday
+	}
+
+	for _, v := range tests {
+		x, err := time.Parse(time.RFC3339, v.Time)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.active(x) != v.Active {
+			t.Errorf("%v: expected active %v", v.Time, v.Active)
+		}
+	}
+}
+
+const testBusinessMappingsCSV = `# state, old state, owned, action
+WARNING,,false,create
+`
+
+const testOutOfHoursMappingsCSV = `# state, old state, owned, action
+CRITICAL,,false,create
+WARNING,,false,ignore
+`
+
+func TestTicketUpdaterSchedule(t *testing.T) {
+	business, err := readMappings(strings.NewReader(testBusinessMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range business {
+		business[i].condition.schedule = scheduleValues("business")
+	}
+
+	outOfHours, err := readMappings(strings.NewReader(testOutOfHoursMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	s, err := newSchedule("business", scheduleConfig{TimeZone: "UTC", Ranges: []string{"Mon-Fri 08:00-18:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Monday night
+	now := time.Date(2018, 10, 1, 22, 0, 0, 0, time.UTC)
+
+	tu := newTicketUpdater(cache, rt, append(business, outOfHours...), "", "Test-Queue", []string{"deleted"})
+	tu.schedules = newSchedules([]*schedule{s})
+	tu.schedules.now = func() time.Time { return now }
+
+	if err := tu.update(newTestEvent("example.com", "night", event.StateWarning)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rt.tickets) != 0 {
+		t.Errorf("ticket created for WARNING out of hours")
+	}
+
+	// Tuesday morning
+	now = time.Date(2018, 10, 2, 9, 0, 0, 0, time.UTC)
+
+	if err := tu.update(newTestEvent("example.com", "day", event.StateWarning)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rt.tickets) != 1 {
+		t.Errorf("no ticket created for WARNING during business hours")
+	}
+}
+
+func TestCheckMappingSchedules(t *testing.T) {
+	ms, err := readRules(strings.NewReader(`[
+		{"when": {"schedule": ["Business-Hours"]}, "then": [{"action": "create"}]},
+		{"when": {"schedule": ["!weekend"]}, "then": [{"action": "comment"}]}
+	]`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schedules := map[string]scheduleConfig{"business-hours": {}, "weekend": {}}
+	if err := checkMappingSchedules(ms, schedules); err != nil {
+		t.Error(err)
+	}
+
+	delete(schedules, "weekend")
+	if err := checkMappingSchedules(ms, schedules); err == nil || !strings.Contains(err.Error(), "unknown schedule weekend in rule 2") {
+		t.Errorf("expected error for unknown schedule, got %v", err)
+	}
+
+	// like in mappings, the schedules of mapping sets are matched case insensitive.
+	if !knownSchedule(schedules, "Business-Hours") || knownSchedule(schedules, "weekend") {
+		t.Errorf("unexpected known schedules")
+	}
+}
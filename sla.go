@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+// rtDateLayout is the format of dates sent to Request Tracker, in UTC.
+const rtDateLayout = "2006-01-02 15:04:05"
+
+// maxScheduleDays limits the search for active times of schedules.
+const maxScheduleDays = 366
+
+// slaPolicy sets the Starts and Due dates of tickets for events matching States and Queue.
+type slaPolicy struct {
+	// States the event must have, an empty list matches every state.
+	States []string `json:",omitempty"`
+	// Queue of the ticket after routing, empty matches every queue.
+	Queue string `json:",omitempty"`
+	// Response is the time from Starts to Due, like "4h".
+	Response string
+	response time.Duration
+	// Schedule honored by the policy, only its active time counts. Every time counts if empty.
+	Schedule string `json:",omitempty"`
+	schedule *schedule
+}
+
+// checkSLA validates the states and durations of SLA policies.
+func checkSLA(policies []slaPolicy) error {
+	for i, v := range policies {
+		if v.response <= 0 {
+			return fmt.Errorf("Response must be set in policy %v", i)
+		}
+
+		for _, s := range v.States {
+			if _, err := normalizeState(s); err != nil {
+				return fmt.Errorf("%v in policy %v", err, i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// interval is a range of time, to is excluded.
+type interval struct {
+	from time.Time
+	to   time.Time
+}
+
+// clock returns the time of day d on day.
+func clock(day time.Time, d time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(d/time.Hour), int(d%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+// intervals returns the sorted, merged intervals the schedule is active on day.
+func (s *schedule) intervals(day time.Time) []interval {
+	if s.holidays[day.Format(holidayLayout)] {
+		return nil
+	}
+
+	xs := []interval{}
+	for _, v := range s.ranges {
+		if v.days[day.Weekday()] {
+			xs = append(xs, interval{from: clock(day, v.start), to: clock(day, v.end)})
+		}
+	}
+
+	sort.Slice(xs, func(i, j int) bool { return xs[i].from.Before(xs[j].from) })
+
+	merged := []interval{}
+	for _, v := range xs {
+		if n := len(merged); n > 0 && !v.from.After(merged[n-1].to) {
+			if v.to.After(merged[n-1].to) {
+				merged[n-1].to = v.to
+			}
+			continue
+		}
+
+		merged = append(merged, v)
+	}
+
+	return merged
+}
+
+// add returns the first active time at or after t and the time d of active time later.
+func (s *schedule) add(t time.Time, d time.Duration) (time.Time, time.Time, error) {
+	t = t.In(s.location)
+
+	var start time.Time
+	for i := 0; i < maxScheduleDays; i++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+i, 0, 0, 0, 0, s.location)
+
+		for _, v := range s.intervals(day) {
+			if !v.to.After(t) {
+				continue
+			}
+
+			if v.from.Before(t) {
+				v.from = t
+			}
+
+			if start.IsZero() {
+				start = v.from
+			}
+
+			if end := v.from.Add(d); !end.After(v.to) {
+				return start, end, nil
+			}
+
+			d -= v.to.Sub(v.from)
+		}
+	}
+
+	return time.Time{}, time.Time{}, fmt.Errorf("schedule %v isn't active within %v days", s.name, maxScheduleDays)
+}
+
+func (p slaPolicy) match(state, hostState string, queue string) bool {
+	if p.Queue != "" && p.Queue != queue {
+		return false
+	}
+
+	if len(p.States) == 0 {
+		return true
+	}
+
+	return values{include: p.States}.matchState(state, hostState)
+}
+
+// dates returns the Starts and Due dates of a ticket created at t.
+func (p slaPolicy) dates(t time.Time) (time.Time, time.Time, error) {
+	if p.schedule == nil {
+		return t, t.Add(p.response), nil
+	}
+
+	return p.schedule.add(t, p.response)
+}
+
+// slaPolicy returns the first policy matching the event and queue, if any.
+func (t *ticketUpdater) slaPolicy(e *event.Notification, queue string) (slaPolicy, bool) {
+	host := hostState(e)
+
+	for _, v := range t.sla {
+		if v.match(e.CheckResult.State.String(), host, queue) {
+			return v, true
+		}
+	}
+
+	return slaPolicy{}, false
+}
+
+// applySLA sets the Starts and Due dates of a ticket for the event created at created.
+func (t *ticketUpdater) applySLA(e *event.Notification, ticket *rt.Ticket, created time.Time) error {
+	p, ok := t.slaPolicy(e, ticket.Queue)
+	if !ok {
+		return nil
+	}
+
+	starts, due, err := p.dates(created)
+	if err != nil {
+		return err
+	}
+
+	ticket.Starts = starts.UTC().Format(rtDateLayout)
+	ticket.Due = due.UTC().Format(rtDateLayout)
+
+	return nil
+}
+
+// updateSLA updates the Starts and Due dates of the ticket of the event after the state worsened, using the policy
+// of the new state from the creation of the ticket on.
+func (t *ticketUpdater) updateSLA(e *event.Notification, ticketID int, queue string) error {
+	entry, err := t.cache.getEntry(e)
+	if err != nil {
+		return err
+	}
+
+	// the action may have removed the ticket or created a new one.
+	if entry == nil || entry.TicketID != ticketID {
+		return nil
+	}
+
+	created := entry.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	changes := &rt.Ticket{ID: ticketID, Queue: queue}
+	if err := t.applySLA(e, changes, created); err != nil {
+		return err
+	}
+
+	if changes.Due == "" {
+		return nil
+	}
+
+	// the queue isn't changed, it's only used for matching.
+	changes.Queue = ""
+
+	if _, err := t.rtClient.UpdateTicket(changes); err != nil {
+		return err
+	}
+
+	if *debug {
+		log.Printf("%x ticket updater: updated SLA dates of ticket #%v: %v, %v", eventID(e), ticketID, changes.Starts, changes.Due)
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func TestScheduleAdd(t *testing.T) {
+	s, err := newSchedule("business", scheduleConfig{TimeZone: "UTC", Ranges: []string{"Mon-Fri 08:00-12:00", "Mon-Fri 11:00-18:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Time     time.Time
+		Duration time.Duration
+		Starts   time.Time
+		Due      time.Time
+	}{
+		// Monday during business hours
+		{Time: time.Date(2018, 10, 1, 9, 0, 0, 0, time.UTC), Duration: 4 * time.Hour, Starts: time.Date(2018, 10, 1, 9, 0, 0, 0, time.UTC), Due: time.Date(2018, 10, 1, 13, 0, 0, 0, time.UTC)},
+		// Monday evening, continued on Tuesday
+		{Time: time.Date(2018, 10, 1, 16, 0, 0, 0, time.UTC), Duration: 4 * time.Hour, Starts: time.Date(2018, 10, 1, 16, 0, 0, 0, time.UTC), Due: time.Date(2018, 10, 2, 10, 0, 0, 0, time.UTC)},
+		// Saturday, starts on Monday
+		{Time: time.Date(2018, 10, 6, 12, 0, 0, 0, time.UTC), Duration: time.Hour, Starts: time.Date(2018, 10, 8, 8, 0, 0, 0, time.UTC), Due: time.Date(2018, 10, 8, 9, 0, 0, 0, time.UTC)},
+		// ends exactly at the end of the day
+		{Time: time.Date(2018, 10, 1, 8, 0, 0, 0, time.UTC), Duration: 10 * time.Hour, Starts: time.Date(2018, 10, 1, 8, 0, 0, 0, time.UTC), Due: time.Date(2018, 10, 1, 18, 0, 0, 0, time.UTC)},
+	}
+
+	for i, v := range tests {
+		starts, due, err := s.add(v.Time, v.Duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !starts.Equal(v.Starts) || !due.Equal(v.Due) {
+			t.Errorf("test %v: got %v - %v, expected %v - %v", i, starts, due, v.Starts, v.Due)
+		}
+	}
+}
+
+func TestTicketUpdaterSLA(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+	tu.sla = []slaPolicy{
+		{States: []string{"CRITICAL"}, response: time.Hour},
+		{Queue: "Test-Queue", response: 8 * time.Hour},
+	}
+
+	before := time.Now().UTC().Add(-time.Second)
+
+	for _, v := range []*event.Notification{
+		newTestEvent("example.com", "example", event.StateWarning),
+		newTestEvent("example.com", "example", event.StateCritical),
+	} {
+		if err := tu.update(v); err != nil {
+			t.Fatal(err)
+		}
+
+		starts, err := time.Parse(rtDateLayout, rt.tickets[0].Starts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		due, err := time.Parse(rtDateLayout, rt.tickets[0].Due)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := 8 * time.Hour
+		if v.CheckResult.State == event.StateCritical {
+			expected = time.Hour
+		}
+
+		if starts.Before(before) || due.Sub(starts) != expected {
+			t.Errorf("%v: unexpected dates %v - %v", v.CheckResult.State, starts, due)
+		}
+	}
+}
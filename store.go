@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Backends of the cache.
+const (
+	backendBolt   = "bolt"
+	backendJSON   = "json"
+	backendMemory = "memory"
+)
+
+// errTxNotWritable is returned by changes in read-only transactions.
+var errTxNotWritable = errors.New("transaction not writable")
+
+// Store is the storage of the cache, a set of buckets of keys and values.
+type Store interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(StoreTx) error) error
+	// Update runs fn in a read-write transaction, which is discarded if fn returns an error.
+	Update(fn func(StoreTx) error) error
+	// Snapshot writes a consistent copy of the store in the format of its file, returning the number of bytes
+	// written. Updates can run while it's written.
+	Snapshot(w io.Writer) (int64, error)
+	Close() error
+}
+
+// StoreTx is a transaction of a Store. Keys and values returned are only valid during the transaction and must not
+// be modified.
+type StoreTx interface {
+	// Get returns the value of the key in the bucket, or nil if it doesn't exist.
+	Get(bucket string, key []byte) []byte
+	// Put sets the value of the key in the bucket, creating the bucket if it doesn't exist.
+	Put(bucket string, key []byte, value []byte) error
+	// Delete removes the key from the bucket, if it exists.
+	Delete(bucket string, key []byte) error
+	// ForEach calls fn for the keys of the bucket starting with prefix in their order, fn must not change the bucket.
+	ForEach(bucket string, prefix []byte, fn func(k []byte, v []byte) error) error
+	// NextSequence returns the next sequence number of the bucket, creating the bucket if it doesn't exist.
+	NextSequence(bucket string) (uint64, error)
+	// DeleteBucket removes the bucket and its keys, if it exists.
+	DeleteBucket(bucket string) error
+}
+
+// openStore opens the store of the backend at path, the memory backend doesn't use path.
+func openStore(backend string, path string) (Store, error) {
+	switch backend {
+	case "", backendBolt:
+		return openBoltStore(path)
+	case backendJSON:
+		return openJSONStore(path)
+	case backendMemory:
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown backend %v", backend)
+	}
+}
+
+// openSnapshot opens a snapshot of the backend at path read-only, without locking it. Snapshots of the memory
+// backend are in the format of the json backend.
+func openSnapshot(backend string, path string) (Store, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	switch backend {
+	case "", backendBolt:
+		return openBoltSnapshot(path)
+	case backendJSON, backendMemory:
+		data, err := readJSONFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return &memoryStore{data: data}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %v", backend)
+	}
+}
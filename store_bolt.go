@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	bolt "github.com/etcd-io/bbolt" // bbolt is the continuation of bolt and for now is usable as drop in replacement
+)
+
+// boltStore is a Store in a bolt database.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore opens the bolt database at path, waiting cacheLockTimeout for its lock.
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: cacheLockTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("cache %v is locked, icinga2rt is probably running and has to be stopped first", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// openBoltSnapshot opens the bolt database at path read-only.
+func openBoltSnapshot(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: cacheLockTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) View(fn func(StoreTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) Update(fn func(StoreTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) Snapshot(w io.Writer) (int64, error) {
+	var n int64
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+
+	return n, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltTx is a StoreTx of a bolt transaction.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Get(bucket string, key []byte) []byte {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	return b.Get(key)
+}
+
+func (t boltTx) Put(bucket string, key []byte, value []byte) error {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key, value)
+}
+
+func (t boltTx) Delete(bucket string, key []byte) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	return b.Delete(key)
+}
+
+func (t boltTx) ForEach(bucket string, prefix []byte, fn func(k []byte, v []byte) error) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t boltTx) NextSequence(bucket string) (uint64, error) {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return 0, err
+	}
+
+	return b.NextSequence()
+}
+
+func (t boltTx) DeleteBucket(bucket string) error {
+	err := t.tx.DeleteBucket([]byte(bucket))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+
+	return err
+}
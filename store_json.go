@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// jsonStore is a Store in a JSON file for small setups. The file is read when opened and rewritten by every update.
+type jsonStore struct {
+	*memoryStore
+	path string
+	lock *fileLock
+}
+
+// jsonFile is the content of the file of a jsonStore.
+type jsonFile struct {
+	Buckets   map[string][]jsonValue `json:"buckets"`
+	Sequences map[string]uint64      `json:"sequences,omitempty"`
+}
+
+// jsonValue is a key and value of a bucket. Keys which aren't valid UTF-8 are saved in KeyBase64, values which
+// aren't compact JSON in ValueBase64.
+type jsonValue struct {
+	Key         string          `json:"key,omitempty"`
+	KeyBase64   []byte          `json:"keyBase64,omitempty"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	ValueBase64 []byte          `json:"valueBase64,omitempty"`
+}
+
+// openJSONStore opens the JSON file at path, it's created by the first update if it doesn't exist. The file is
+// locked by path.lock, waiting cacheLockTimeout for the lock.
+func openJSONStore(path string) (*jsonStore, error) {
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readJSONFile(path)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	s := &jsonStore{memoryStore: newMemoryStore(), path: path, lock: lock}
+	s.data = data
+	s.commit = s.write
+
+	return s, nil
+}
+
+func readJSONFile(path string) (*memoryData, error) {
+	data := newMemoryData()
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var x jsonFile
+	if err := json.Unmarshal(b, &x); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	for name, values := range x.Buckets {
+		bucket := make(map[string][]byte, len(values))
+		for _, v := range values {
+			key := []byte(v.Key)
+			if v.KeyBase64 != nil {
+				key = v.KeyBase64
+			}
+
+			value := v.ValueBase64
+			if v.Value != nil {
+				// values are saved indented, they were compact before.
+				buf := &bytes.Buffer{}
+				if err := json.Compact(buf, v.Value); err != nil {
+					return nil, fmt.Errorf("%v: %v", path, err)
+				}
+				value = buf.Bytes()
+			}
+
+			// empty values are saved without value.
+			if value == nil {
+				value = []byte{}
+			}
+
+			bucket[string(key)] = value
+		}
+
+		data.buckets[name] = bucket
+	}
+
+	for k, v := range x.Sequences {
+		data.sequences[k] = v
+	}
+
+	return data, nil
+}
+
+// marshalJSONFile returns the content of the file of a jsonStore with the data.
+func marshalJSONFile(data *memoryData) ([]byte, error) {
+	x := jsonFile{Buckets: make(map[string][]jsonValue, len(data.buckets)), Sequences: data.sequences}
+
+	for name := range data.buckets {
+		values := []jsonValue{}
+		err := (&memoryTx{data: data}).ForEach(name, nil, func(k, v []byte) error {
+			y := jsonValue{}
+
+			if utf8.Valid(k) {
+				y.Key = string(k)
+			} else {
+				y.KeyBase64 = k
+			}
+
+			if isCompactJSON(v) {
+				y.Value = v
+			} else {
+				y.ValueBase64 = v
+			}
+
+			values = append(values, y)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		x.Buckets[name] = values
+	}
+
+	return json.MarshalIndent(x, "", "\t")
+}
+
+// write replaces the file with the data, using a temporary file so it's never incomplete.
+func (s *jsonStore) write(data *memoryData) error {
+	b, err := marshalJSONFile(data)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
+
+// isCompactJSON returns true if x is JSON without spaces between tokens, so it's unchanged when indented and
+// compacted again.
+func isCompactJSON(x []byte) bool {
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, x); err != nil {
+		return false
+	}
+
+	return bytes.Equal(buf.Bytes(), x)
+}
+
+func (s *jsonStore) Close() error {
+	return s.lock.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryData are the buckets and sequences of a memoryStore.
+type memoryData struct {
+	buckets   map[string]map[string][]byte
+	sequences map[string]uint64
+}
+
+func newMemoryData() *memoryData {
+	return &memoryData{buckets: make(map[string]map[string][]byte), sequences: make(map[string]uint64)}
+}
+
+// clone copies the buckets, values aren't changed in place so they are shared.
+func (d *memoryData) clone() *memoryData {
+	x := newMemoryData()
+
+	for name, b := range d.buckets {
+		y := make(map[string][]byte, len(b))
+		for k, v := range b {
+			y[k] = v
+		}
+		x.buckets[name] = y
+	}
+
+	for k, v := range d.sequences {
+		x.sequences[k] = v
+	}
+
+	return x
+}
+
+// memoryStore is a Store in memory, for tests and dry runs. Update transactions work on a copy of the data.
+type memoryStore struct {
+	mu   sync.RWMutex
+	data *memoryData
+	// commit is called with the changed data of an update before it replaces the data of the store, optional.
+	commit func(*memoryData) error
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: newMemoryData()}
+}
+
+func (s *memoryStore) View(fn func(StoreTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memoryTx{data: s.data})
+}
+
+func (s *memoryStore) Update(fn func(StoreTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := s.data.clone()
+	if err := fn(&memoryTx{data: data, writable: true}); err != nil {
+		return err
+	}
+
+	if s.commit != nil {
+		if err := s.commit(data); err != nil {
+			return err
+		}
+	}
+
+	s.data = data
+	return nil
+}
+
+// Snapshot writes the data in the format of the json backend.
+func (s *memoryStore) Snapshot(w io.Writer) (int64, error) {
+	s.mu.RLock()
+	b, err := marshalJSONFile(s.data)
+	s.mu.RUnlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// memoryTx is a StoreTx of a memoryStore.
+type memoryTx struct {
+	data     *memoryData
+	writable bool
+}
+
+func (t *memoryTx) Get(bucket string, key []byte) []byte {
+	return t.data.buckets[bucket][string(key)]
+}
+
+func (t *memoryTx) Put(bucket string, key []byte, value []byte) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+
+	b, ok := t.data.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		t.data.buckets[bucket] = b
+	}
+
+	b[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (t *memoryTx) Delete(bucket string, key []byte) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+
+	delete(t.data.buckets[bucket], string(key))
+	return nil
+}
+
+func (t *memoryTx) ForEach(bucket string, prefix []byte, fn func(k []byte, v []byte) error) error {
+	b := t.data.buckets[bucket]
+
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := fn([]byte(k), b[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryTx) NextSequence(bucket string) (uint64, error) {
+	if !t.writable {
+		return 0, errTxNotWritable
+	}
+
+	if _, ok := t.data.buckets[bucket]; !ok {
+		t.data.buckets[bucket] = make(map[string][]byte)
+	}
+
+	t.data.sequences[bucket]++
+	return t.data.sequences[bucket], nil
+}
+
+func (t *memoryTx) DeleteBucket(bucket string) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+
+	delete(t.data.buckets, bucket)
+	delete(t.data.sequences, bucket)
+	return nil
+}
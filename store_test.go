@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+// testStores calls fn with a store of every backend.
+func testStores(t *testing.T, fn func(t *testing.T, s Store)) {
+	dir, err := os.MkdirTemp("", "icinga2rt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, backend := range []string{backendBolt, backendJSON, backendMemory} {
+		t.Run(backend, func(t *testing.T) {
+			s, err := openStore(backend, filepath.Join(dir, "icinga2rt."+backend))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			fn(t, s)
+		})
+	}
+}
+
+// testCaches calls fn with a cache in a store of every backend.
+func testCaches(t *testing.T, fn func(t *testing.T, c *cache)) {
+	testStores(t, func(t *testing.T, s Store) {
+		c, err := newCache(s, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fn(t, c)
+	})
+}
+
+func TestStore(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		err := s.Update(func(tx StoreTx) error {
+			for _, k := range []string{"b/2", "a/1", "b/1", "c"} {
+				if err := tx.Put("test", []byte(k), []byte(k)); err != nil {
+					return err
+				}
+			}
+
+			return tx.Delete("test", []byte("c"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.View(func(tx StoreTx) error {
+			if x := tx.Get("test", []byte("a/1")); string(x) != "a/1" {
+				t.Errorf("expected a/1, got %q", x)
+			}
+
+			if x := tx.Get("test", []byte("c")); x != nil {
+				t.Errorf("deleted key: expected nil, got %q", x)
+			}
+
+			if x := tx.Get("missing", []byte("a/1")); x != nil {
+				t.Errorf("missing bucket: expected nil, got %q", x)
+			}
+
+			keys := []string{}
+			err := tx.ForEach("test", []byte("b/"), func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if expected := []string{"b/1", "b/2"}; !reflect.DeepEqual(keys, expected) {
+				t.Errorf("expected keys %v, got %v", expected, keys)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestStoreSequence(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		for i := uint64(1); i <= 2; i++ {
+			err := s.Update(func(tx StoreTx) error {
+				seq, err := tx.NextSequence("test")
+				if err != nil {
+					return err
+				}
+
+				if seq != i {
+					t.Errorf("expected sequence %v, got %v", i, seq)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := s.Update(func(tx StoreTx) error {
+			if err := tx.Put("test", []byte("x"), []byte("x")); err != nil {
+				return err
+			}
+
+			if err := tx.DeleteBucket("test"); err != nil {
+				return err
+			}
+
+			// deleting a missing bucket isn't an error.
+			if err := tx.DeleteBucket("test"); err != nil {
+				return err
+			}
+
+			if x := tx.Get("test", []byte("x")); x != nil {
+				t.Errorf("deleted bucket: expected nil, got %q", x)
+			}
+
+			seq, err := tx.NextSequence("test")
+			if err != nil {
+				return err
+			}
+
+			if seq != 1 {
+				t.Errorf("deleted bucket: expected sequence 1, got %v", seq)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestStoreRollback(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		fail := errors.New("fail")
+
+		err := s.Update(func(tx StoreTx) error {
+			if err := tx.Put("test", []byte("x"), []byte("x")); err != nil {
+				return err
+			}
+			return fail
+		})
+		if err != fail {
+			t.Fatalf("expected %v, got %v", fail, err)
+		}
+
+		err = s.View(func(tx StoreTx) error {
+			if x := tx.Get("test", []byte("x")); x != nil {
+				t.Errorf("discarded update: expected nil, got %q", x)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMemoryStoreReadOnly(t *testing.T) {
+	s := newMemoryStore()
+
+	err := s.View(func(tx StoreTx) error {
+		return tx.Put("test", []byte("x"), []byte("x"))
+	})
+	if err != errTxNotWritable {
+		t.Errorf("expected %v, got %v", errTxNotWritable, err)
+	}
+}
+
+func TestJSONStorePersist(t *testing.T) {
+	dir, err := os.MkdirTemp("", "icinga2rt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "icinga2rt.json")
+
+	s, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string][]byte{
+		"json":   []byte(`{"a":1}`),
+		"spaced": []byte(`{"a": 1}`),
+		"text":   []byte("text"),
+		"binary": {0xff, 0x00},
+		"empty":  {},
+	}
+
+	err = s.Update(func(tx StoreTx) error {
+		for k, v := range values {
+			if err := tx.Put("test", []byte(k), v); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Put("test", []byte{0xff}, []byte("key")); err != nil {
+			return err
+		}
+
+		_, err := tx.NextSequence("test")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openJSONStore(path); err == nil {
+		t.Error("expected error opening a locked store")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = s.Update(func(tx StoreTx) error {
+		for k, v := range values {
+			if x := tx.Get("test", []byte(k)); x == nil || string(x) != string(v) {
+				t.Errorf("%v: expected %q, got %q", k, v, x)
+			}
+		}
+
+		if x := tx.Get("test", []byte{0xff}); string(x) != "key" {
+			t.Errorf("binary key: expected %q, got %q", "key", x)
+		}
+
+		seq, err := tx.NextSequence("test")
+		if err != nil {
+			return err
+		}
+
+		if seq != 2 {
+			t.Errorf("expected sequence 2, got %v", seq)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := newCache(newMemoryStore(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	rt := NewDummyRT()
+	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+
+	e := newTestEvent("example.com", "http", event.StateCritical)
+	if err := tu.update(e); err != nil {
+		t.Fatal(err)
+	}
+
+	et, err := cache.getEntry(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if et == nil || et.TicketID != 0 {
+		t.Errorf("expected an entry with ticket 0, got %#v", et)
+	}
+}
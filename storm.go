@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+type stormConfig struct {
+	// Threshold is the maximum number of tickets created within Window, 0 disables the storm protection.
+	Threshold int
+	Window    string
+	window    time.Duration
+	// Queue of the storm ticket, Ticket.Queue is used if empty.
+	Queue string `json:",omitempty"`
+}
+
+// storm limits the number of tickets created within a sliding window. Once the limit is exceeded, a single storm
+// ticket is created instead, and the creation of further tickets is suppressed until the rate drops again.
+// The storm is only kept in memory, a restart during a storm forgets it without commenting the storm ticket.
+type storm struct {
+	threshold int
+	window    time.Duration
+	queue     string
+	now       func() time.Time
+
+	// creates are the times of all ticket creations within the window, suppressed or not.
+	creates []time.Time
+	// ticketID of the storm ticket, -1 if there is no storm.
+	ticketID int
+	// members are the last events of suppressed creations by member name.
+	members map[string]*event.Notification
+	timer   *time.Timer
+}
+
+func newStorm(threshold int, window time.Duration, queue string) *storm {
+	return &storm{threshold: threshold, window: window, queue: queue, now: time.Now, ticketID: -1, members: make(map[string]*event.Notification)}
+}
+
+// prune removes creations which left the window.
+func (s *storm) prune() {
+	limit := s.now().Add(-s.window)
+
+	i := 0
+	for i < len(s.creates) && !s.creates[i].After(limit) {
+		i++
+	}
+
+	s.creates = s.creates[i:]
+}
+
+func formatStormMembers(members map[string]*event.Notification, recovered bool) string {
+	names := []string{}
+	for k, v := range members {
+		if (v.CheckResult.State == event.StateOK) == recovered {
+			names = append(names, k)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	sort.Strings(names)
+
+	if recovered {
+		return strings.Join(names, ", ")
+	}
+
+	failing := make([]string, 0, len(names))
+	for _, v := range names {
+		failing = append(failing, fmt.Sprintf("%v (%v)", v, members[v].CheckResult.State.String()))
+	}
+
+	return strings.Join(failing, ", ")
+}
+
+// stormCreate counts the creation of a ticket for the event. It returns true if the creation must be suppressed
+// because of a storm, opening the storm ticket if the storm just started.
+func (t *ticketUpdater) stormCreate(e *event.Notification) (bool, error) {
+	s := t.storm
+
+	s.prune()
+	s.creates = append(s.creates, s.now())
+
+	if s.ticketID == -1 && len(s.creates) <= s.threshold {
+		return false, nil
+	}
+
+	name := memberName(e)
+	_, known := s.members[name]
+	s.members[name] = e
+
+	if s.ticketID != -1 {
+		if *debug {
+			log.Printf("%x ticket updater: suppressed ticket creation during alert storm", eventID(e))
+		}
+
+		if known {
+			return true, nil
+		}
+
+		// the storm ticket only lists the members when the storm started.
+		comment := fmt.Sprintf("Also affected: %v (%v)", name, e.CheckResult.State.String())
+		return true, t.rtClient.CommentTicket(s.ticketID, comment)
+	}
+
+	queue := s.queue
+	if queue == "" {
+		queue = t.queue
+	}
+
+	ticket := &rt.Ticket{
+		Queue:   queue,
+		Subject: fmt.Sprintf("Alert storm: more than %v tickets within %v", s.threshold, s.window),
+		Text:    fmt.Sprintf("Creation of tickets is suspended until the storm ends. Affected: %v", formatStormMembers(s.members, false)),
+	}
+
+	newTicket, err := t.rtClient.NewTicket(ticket)
+	if err != nil {
+		// there is no storm ticket, so the event isn't a member, otherwise its later events would be swallowed.
+		delete(s.members, memberName(e))
+		return false, err
+	}
+
+	log.Printf("ticket updater: alert storm started, created storm ticket #%v", newTicket.ID)
+
+	s.ticketID = newTicket.ID
+	t.scheduleStormEnd()
+
+	return true, nil
+}
+
+// stormTrack updates the state of an event whose ticket creation was suppressed during the current storm.
+// It returns true if the event is a member of the storm and must not be processed further.
+func (t *ticketUpdater) stormTrack(e *event.Notification) bool {
+	if t.storm.ticketID == -1 {
+		return false
+	}
+
+	name := memberName(e)
+	if _, ok := t.storm.members[name]; !ok {
+		return false
+	}
+
+	if *debug {
+		log.Printf("%x ticket updater: tracking event of alert storm", eventID(e))
+	}
+
+	t.storm.members[name] = e
+	return true
+}
+
+// scheduleStormEnd starts a timer for the time the number of creations within the window drops to the threshold.
+func (t *ticketUpdater) scheduleStormEnd() {
+	s := t.storm
+
+	d := s.window
+	if len(s.creates) > s.threshold {
+		d = s.creates[len(s.creates)-s.threshold-1].Add(s.window).Sub(s.now())
+	}
+
+	s.timer = time.AfterFunc(d, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if err := t.checkStorm(); err != nil {
+			log.Printf("ticket updater: couldn't end alert storm: %v", err)
+		}
+	})
+}
+
+// checkStorm ends the storm if the number of creations within the window doesn't exceed the threshold anymore,
+// commenting the storm ticket with a summary of recovered and still failing events. Otherwise the check is
+// scheduled again.
+func (t *ticketUpdater) checkStorm() error {
+	s := t.storm
+	if s.ticketID == -1 {
+		return nil
+	}
+
+	s.prune()
+	if len(s.creates) > s.threshold {
+		t.scheduleStormEnd()
+		return nil
+	}
+
+	comment := fmt.Sprintf("Alert storm ended. Recovered: %v. Still failing: %v.", formatStormMembers(s.members, true), formatStormMembers(s.members, false))
+	if err := t.rtClient.CommentTicket(s.ticketID, comment); err != nil {
+		t.scheduleStormEnd()
+		return err
+	}
+
+	log.Printf("ticket updater: alert storm ended, commented storm ticket #%v", s.ticketID)
+
+	s.ticketID = -1
+	s.members = make(map[string]*event.Notification)
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytemine/go-icinga2/event"
+)
+
+func TestTicketUpdaterStorm(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+	tu.storm = newStorm(2, time.Minute, "storm")
+	tu.storm.now = func() time.Time { return now }
+
+	steps := []struct {
+		Event   *event.Notification
+		Tickets int // number of tickets created after processing
+	}{
+		{Event: newTestEvent("h1", "", event.StateCritical), Tickets: 1},
+		{Event: newTestEvent("h2", "", event.StateCritical), Tickets: 2},
+		// the storm starts, a storm ticket is created instead.
+		{Event: newTestEvent("h3", "", event.StateCritical), Tickets: 3},
+		{Event: newTestEvent("h4", "", event.StateCritical), Tickets: 3},
+		{Event: newTestEvent("h3", "", event.StateOK), Tickets: 3},
+		{Event: newTestEvent("h4", "", event.StateWarning), Tickets: 3},
+	}
+
+	for i, v := range steps {
+		now = now.Add(time.Second)
+
+		if err := tu.update(v.Event); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rt.tickets) != v.Tickets {
+			t.Errorf("step %v: got %v tickets, expected %v", i, len(rt.tickets), v.Tickets)
+		}
+	}
+
+	tu.mu.Lock()
+	defer tu.mu.Unlock()
+
+	tu.storm.timer.Stop()
+
+	if rt.tickets[2].Queue != "storm" || !strings.Contains(rt.tickets[2].Text, "h3 (CRITICAL)") {
+		t.Errorf("unexpected storm ticket: %+v", rt.tickets[2])
+	}
+
+	// the storm is still going on.
+	if err := tu.checkStorm(); err != nil {
+		t.Fatal(err)
+	}
+	tu.storm.timer.Stop()
+
+	// h4 was suppressed after the storm ticket was created.
+	if len(rt.comments[2]) != 1 || rt.comments[2][0] != "Also affected: h4 (CRITICAL)" {
+		t.Errorf("unexpected comments of the storm ticket: %v", rt.comments[2])
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if err := tu.checkStorm(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rt.comments[2]) != 2 || rt.comments[2][1] != "Alert storm ended. Recovered: h3. Still failing: h4 (WARNING)." {
+		t.Errorf("unexpected storm summary: %v", rt.comments[2])
+	}
+
+	if tu.storm.ticketID != -1 || len(tu.storm.members) != 0 {
+		t.Errorf("storm wasn't reset")
+	}
+}
+
+func TestTicketUpdaterStormTicketFailed(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewDummyRT()
+	cache, cachePath, err := tempCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCache(cache, cachePath)
+
+	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+	tu.storm = newStorm(0, time.Minute, "storm")
+
+	rt.failCreates = true
+	if err := tu.update(newTestEvent("h1", "", event.StateCritical)); err == nil {
+		t.Fatal("expected error for failed storm ticket")
+	}
+
+	if len(tu.storm.members) != 0 {
+		t.Errorf("event became member of a storm without ticket: %v", tu.storm.members)
+	}
+
+	// the event isn't swallowed, the storm starts with the next creation.
+	rt.failCreates = false
+	if err := tu.update(newTestEvent("h1", "", event.StateCritical)); err != nil {
+		t.Fatal(err)
+	}
+
+	tu.mu.Lock()
+	defer tu.mu.Unlock()
+
+	tu.storm.timer.Stop()
+
+	if len(rt.tickets) != 1 || rt.tickets[0].Queue != "storm" {
+		t.Errorf("expected the storm ticket, got %+v", rt.tickets)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/bytemine/go-icinga2/event"
 	"github.com/bytemine/icinga2rt/rt"
@@ -10,37 +12,171 @@ import (
 
 type actionFunc func(*ticketUpdater, *event.Notification) error
 
-// condition describes the properties an event must have to match.
-type condition struct {
-	state    event.State
-	oldState event.State
-	owned    bool
+// actionChain returns an action running the actions in order. If an action fails, the remaining actions are skipped
+// and the cache entry of the event is restored to its state before the chain. The names of the actions are used to
+// report which step failed.
+func actionChain(names []string, actions []actionFunc) actionFunc {
+	return func(t *ticketUpdater, e *event.Notification) error {
+		old, err := t.cache.getEntry(e)
+		if err != nil {
+			return err
+		}
+
+		for i, action := range actions {
+			err := action(t, e)
+			if err == nil {
+				continue
+			}
+
+			if *debug {
+				log.Printf("%x ticket updater: action %v failed, restoring cache entry", eventID(e), names[i])
+			}
+
+			if old == nil {
+				err2 := t.cache.deleteEventTicket(e)
+				if err2 != nil {
+					return fmt.Errorf("step %v of %v (%v) failed: %v, restoring cache failed: %v", i+1, len(actions), names[i], err, err2)
+				}
+			} else {
+				err2 := t.cache.putEntry(old)
+				if err2 != nil {
+					return fmt.Errorf("step %v of %v (%v) failed: %v, restoring cache failed: %v", i+1, len(actions), names[i], err, err2)
+				}
+			}
+
+			return fmt.Errorf("step %v of %v (%v) failed: %v", i+1, len(actions), names[i], err)
+		}
+
+		return nil
+	}
 }
 
 // mapping describes how an event matching condition should be acted upon.
 type mapping struct {
 	condition condition
 	action    actionFunc
+	// name of the action, recorded in the history of the cache entry.
+	name string
+	// source of the mapping, like "mappings.csv line 12", recorded in the audit entries.
+	source string
 }
 
 type ticketUpdater struct {
+	// mu serializes updates and timers.
+	mu sync.Mutex
+
 	cache        *cache
 	rtClient     rtClient
 	mappings     []mapping
 	nobody       string
 	queue        string
 	closedStatus []string
+
+	// routing rules applied to new tickets, optional.
+	routing []routingRule
+	// hostFolding mode for service events of hosts with open tickets, disabled if empty.
+	hostFolding string
+	// grouping key of events sharing a ticket, disabled if empty.
+	grouping string
+	// objects is used to look up attributes not contained in events, optional.
+	objects objectsClient
+	// groupKeys are the cached group keys by host.
+	groupKeys map[string]groupKeyLookup
+	// member is the event of the group member handled by the current update, used to route group tickets.
+	member *event.Notification
+	// createDelay is the grace period of delayed ticket creations.
+	createDelay time.Duration
+	// timers of pending ticket creations by event id.
+	timers map[string]*time.Timer
+	// storm limits the rate of ticket creations, optional.
+	storm *storm
+	// resolvedStatus is set by the resolve action.
+	resolvedStatus string
+	// openStatus is set by the reopen action.
+	openStatus string
+	// reopenWindow is the duration after resolving a ticket in which it is reopened, 0 means forever.
+	reopenWindow time.Duration
+	// notifications are the handlings of notification types by type, optional.
+	notifications map[string]notificationHandling
+	// users maps notified users to requestors and owners of new tickets, optional.
+	users *users
+	// schedules selecting mappings, optional.
+	schedules *schedules
+	// escalation of unowned tickets, optional.
+	escalation *escalation
+	// sla policies setting the dates of new tickets, optional.
+	sla []slaPolicy
+	// audit records the decisions of updates, optional.
+	audit *audit
+	// decision of the current update, recorded if audit is set.
+	decision *auditEntry
+	// gc removes stale entries, optional.
+	gc *gc
 }
 
 func newTicketUpdater(cache *cache, rtClient rtClient, mappings []mapping, nobody string, queue string, closedStatus []string) *ticketUpdater {
-	return &ticketUpdater{cache: cache, rtClient: rtClient, mappings: mappings, nobody: nobody, queue: queue, closedStatus: closedStatus}
+	return &ticketUpdater{cache: cache, rtClient: rtClient, mappings: mappings, nobody: nobody, queue: queue, closedStatus: closedStatus, timers: make(map[string]*time.Timer), resolvedStatus: "resolved", openStatus: "open"}
 }
 
-func (t *ticketUpdater) update(e *event.Notification) error {
+func (t *ticketUpdater) update(e *event.Notification) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	if *debug {
 		log.Printf("%x ticket updater: new event: %v", eventID(e), formatEventSubject(e))
 	}
 
+	// the key is looked up once for the update and its audit entry.
+	group := ""
+	if t.grouping != "" {
+		group = t.groupKey(e)
+	}
+
+	if t.audit != nil {
+		t.auditStart(e)
+		defer func() { t.auditFinish(e, group, err) }()
+	}
+
+	if t.hostFolding != "" && e.Service != "" {
+		folded, err := t.fold(e)
+		if err != nil {
+			return err
+		}
+
+		if folded {
+			t.auditAction("", "fold")
+			return nil
+		}
+	}
+
+	if t.grouping != "" {
+		return t.updateGroup(e, group)
+	}
+
+	return t.match(e)
+}
+
+// match applies the action of the first mapping matching the event.
+func (t *ticketUpdater) match(e *event.Notification) error {
+	// events whose ticket creation was suppressed are only tracked until the storm ends.
+	if t.storm != nil && t.stormTrack(e) {
+		t.auditAction("", "storm")
+		return nil
+	}
+
+	// a recovery within the grace period of a delayed creation cancels it, there is nothing else to do.
+	if recovered(e) {
+		canceled, err := t.cancelPending(e)
+		if err != nil {
+			return err
+		}
+
+		if canceled {
+			t.auditAction("", "cancel delayed creation")
+			return nil
+		}
+	}
+
 	// get a possible old event and ticket from the cache
 	oldEvent, ticketID, err := t.cache.getEventTicket(e)
 	if err != nil {
@@ -49,7 +185,9 @@ func (t *ticketUpdater) update(e *event.Notification) error {
 
 	// assume a fresh event
 	owned := false
-	oldState := event.State(event.StateNil)
+	var old *event.Notification
+	ticketStatus := ""
+	queue := ""
 
 	// use switch here so we can use break
 	switch {
@@ -63,18 +201,18 @@ func (t *ticketUpdater) update(e *event.Notification) error {
 		}
 
 		// we have an old event
-		oldState = oldEvent.CheckResult.State
+		old = oldEvent
 		owned = oldTicket.Owner != t.nobody
+		ticketStatus = oldTicket.Status
+		queue = oldTicket.Queue
 
 		// check if the ticket has a status which signals "closed".
 		// if it is closed, we have no old status and the ticket is unowned.
-		for _, v := range t.closedStatus {
-			if oldTicket.Status == v {
-				oldState = event.State(event.StateNil)
-				owned = false
-				if *debug {
-					log.Printf("%x ticket updater: ticket #%v has closed status: %v", eventID(e), ticketID, oldTicket.Status)
-				}
+		if t.closed(oldTicket) {
+			old = nil
+			owned = false
+			if *debug {
+				log.Printf("%x ticket updater: ticket #%v has closed status: %v", eventID(e), ticketID, oldTicket.Status)
 			}
 		}
 	}
@@ -83,24 +221,49 @@ func (t *ticketUpdater) update(e *event.Notification) error {
 		log.Printf("%x ticket updater: ticket #%v owned: %v", eventID(e), ticketID, owned)
 	}
 
-	for _, v := range t.mappings {
-		x := condition{
-			state:    e.CheckResult.State,
-			oldState: oldState,
-			owned:    owned,
-		}
+	t.auditFacts(old, owned)
+
+	// notifications with a handling don't use the mappings.
+	if h, ok := t.notificationHandling(e); ok {
+		t.auditAction(fmt.Sprintf("notification %v", e.NotificationType), h.Action)
+		return t.handleNotification(e, h, ticketID, old != nil)
+	}
+
+	x := newFacts(e, old, owned)
+	x.ticketStatus = ticketStatus
+	x.queue = queue
 
+	if t.schedules != nil {
+		x.schedules = t.schedules.active()
+	}
+
+	for _, v := range t.mappings {
 		if *debug {
 			log.Printf("%x ticket updater: matching condition: %+v\tevent: %+v", eventID(e), v.condition, x)
 		}
 
-		if v.condition == x {
+		if v.condition.match(x) {
 			if *debug {
 				log.Printf("%x ticket updater: matched %+v", eventID(e), v.condition)
 			}
 
+			t.auditAction(v.source, v.name)
+
 			err := v.action(t, e)
-			return err
+			if err != nil {
+				return err
+			}
+
+			if err := t.recordHistory(e, v.name, ticketID, ticketStatus); err != nil {
+				return err
+			}
+
+			// a worse state may have a shorter response time.
+			if len(t.sla) != 0 && old != nil && severity(e.CheckResult.State) > severity(old.CheckResult.State) {
+				return t.updateSLA(e, ticketID, queue)
+			}
+
+			return nil
 		}
 	}
 
@@ -108,9 +271,60 @@ func (t *ticketUpdater) update(e *event.Notification) error {
 		log.Printf("%x ticket updater: no condition matched", eventID(e))
 	}
 
+	t.auditAction("", "none")
+
 	return nil
 }
 
+// recordHistory appends the action to the history of the cache entry of the event. The status of the ticket seen
+// before the action is kept if the entry still refers to the same ticket.
+func (t *ticketUpdater) recordHistory(e *event.Notification, action string, ticketID int, ticketStatus string) error {
+	entry, err := t.cache.getEntry(e)
+	if err != nil {
+		return err
+	}
+
+	// the action may have removed the entry.
+	if entry == nil {
+		return nil
+	}
+
+	if entry.TicketID == ticketID && ticketStatus != "" {
+		entry.TicketStatus = ticketStatus
+	}
+
+	entry.History = append(entry.History, historyEntry{Time: time.Now().UTC(), State: stateString(e), Action: action})
+	if len(entry.History) > maxHistory {
+		entry.History = entry.History[len(entry.History)-maxHistory:]
+	}
+
+	return t.cache.putEntry(entry)
+}
+
+// closed returns true if the ticket has a status which signals "closed".
+func (t *ticketUpdater) closed(ticket *rt.Ticket) bool {
+	for _, v := range t.closedStatus {
+		if ticket.Status == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// openTicket returns true if the ticket exists and isn't closed.
+func (t *ticketUpdater) openTicket(ticketID int) bool {
+	ticket, err := t.rtClient.Ticket(ticketID)
+	if err != nil {
+		if *debug {
+			log.Printf("ticket updater: ticket #%v doesn't exist", ticketID)
+		}
+		return false
+	}
+
+	return !t.closed(ticket)
+}
+
 func (t *ticketUpdater) delete(e *event.Notification) error {
 	_, ticketID, err := t.cache.getEventTicket(e)
 	if err != nil {
@@ -140,18 +354,36 @@ func formatEventSubject(e *event.Notification) string {
 	case e.Host != "" && e.Service != "":
 		return fmt.Sprintf("Host: %v Service: %v is %v", e.Host, e.Service, e.CheckResult.State.String())
 	case e.Host != "" && e.Service == "":
-		return fmt.Sprintf("Host: %v is %v", e.Host, e.CheckResult.State.String())
+		return fmt.Sprintf("Host: %v is %v", e.Host, stateString(e))
 	default:
 		return fmt.Sprintf("Host: %v Service: %v is %v", e.Host, e.Service, e.CheckResult.State.String())
 	}
 }
 
+// formatSubject returns the subject of tickets for the event.
+func (t *ticketUpdater) formatSubject(e *event.Notification) string {
+	if t.grouping != "" {
+		return formatGroupSubject(t.grouping, e)
+	}
+
+	return formatEventSubject(e)
+}
+
 func formatEventComment(e *event.Notification) string {
 	if e.CheckResult.Output != "" {
-		return fmt.Sprintf("New status: %v Output: %v", e.CheckResult.State.String(), e.CheckResult.Output)
+		return fmt.Sprintf("New status: %v Output: %v", stateString(e), e.CheckResult.Output)
+	}
+
+	return stateString(e)
+}
+
+// formatComment returns the comment of ticket updates for the event.
+func (t *ticketUpdater) formatComment(e *event.Notification) string {
+	if t.grouping != "" {
+		return formatGroupComment(e)
 	}
 
-	return e.CheckResult.State.String()
+	return formatEventComment(e)
 }
 
 func (t *ticketUpdater) comment(e *event.Notification) error {
@@ -160,7 +392,15 @@ func (t *ticketUpdater) comment(e *event.Notification) error {
 		return err
 	}
 
-	err = t.rtClient.CommentTicket(ticketID, formatEventComment(e))
+	// mappings matching any old state also match events without ticket, there is nothing to comment.
+	if ticketID == -1 {
+		if *debug {
+			log.Printf("%x ticket updater: no ticket to comment", eventID(e))
+		}
+		return nil
+	}
+
+	err = t.rtClient.CommentTicket(ticketID, t.formatComment(e))
 	if err != nil {
 		return err
 	}
@@ -178,7 +418,23 @@ func (t *ticketUpdater) comment(e *event.Notification) error {
 }
 
 func (t *ticketUpdater) create(e *event.Notification) error {
-	ticket := &rt.Ticket{Queue: t.queue, Subject: formatEventSubject(e), Text: fmt.Sprintf("Output: %s", e.CheckResult.Output)}
+	if t.storm != nil {
+		suppressed, err := t.stormCreate(e)
+		if err != nil || suppressed {
+			return err
+		}
+	}
+
+	ticket := &rt.Ticket{Queue: t.queue, Subject: t.formatSubject(e), Text: fmt.Sprintf("Output: %s", e.CheckResult.Output)}
+	route(t.routing, t.routingEvent(e), ticket)
+
+	if t.users != nil {
+		t.users.apply(e, ticket)
+	}
+
+	if err := t.applySLA(e, ticket, time.Now()); err != nil {
+		log.Printf("%x ticket updater: couldn't set SLA dates: %v", eventID(e), err)
+	}
 
 	newTicket, err := t.rtClient.NewTicket(ticket)
 	if err != nil {
@@ -203,3 +459,116 @@ func (t *ticketUpdater) ignore(e *event.Notification) error {
 	}
 	return nil
 }
+
+// existingTicket returns the id of the cached ticket for the event, or -1 if there is none.
+func (t *ticketUpdater) existingTicket(e *event.Notification) (int, error) {
+	_, ticketID, err := t.cache.getEventTicket(e)
+	if err != nil {
+		return -1, err
+	}
+
+	if ticketID == -1 && *debug {
+		log.Printf("%x ticket updater: no ticket to update", eventID(e))
+	}
+
+	return ticketID, nil
+}
+
+// updateTicket applies the changes to the cached ticket of the event and saves the event.
+func (t *ticketUpdater) updateTicket(e *event.Notification, changes *rt.Ticket) error {
+	ticketID, err := t.existingTicket(e)
+	if err != nil || ticketID == -1 {
+		return err
+	}
+
+	changes.ID = ticketID
+
+	_, err = t.rtClient.UpdateTicket(changes)
+	if err != nil {
+		return err
+	}
+
+	if *debug {
+		log.Printf("%x ticket updater: updated ticket #%v: %+v", eventID(e), ticketID, changes)
+	}
+
+	return t.cache.updateEventTicket(e, ticketID)
+}
+
+func (t *ticketUpdater) resolve(e *event.Notification) error {
+	ticketID, err := t.existingTicket(e)
+	if err != nil || ticketID == -1 {
+		return err
+	}
+
+	err = t.rtClient.CommentTicket(ticketID, t.formatComment(e))
+	if err != nil {
+		return err
+	}
+
+	_, err = t.rtClient.UpdateTicket(&rt.Ticket{ID: ticketID, Status: t.resolvedStatus})
+	if err != nil {
+		return err
+	}
+
+	if *debug {
+		log.Printf("%x ticket updater: resolved ticket #%v", eventID(e), ticketID)
+	}
+
+	entry, err := t.cache.getEntry(e)
+	if err != nil {
+		return err
+	}
+
+	if entry == nil {
+		entry = &eventTicket{TicketID: ticketID}
+	}
+
+	// keep the entry, so the ticket can be reopened.
+	entry.Event = e
+	entry.Resolved = time.Now()
+
+	return t.cache.putEntry(entry)
+}
+
+// reopen sets a ticket resolved within the reopen window back to open and comments it. If there is no such ticket,
+// a new ticket is created.
+func (t *ticketUpdater) reopen(e *event.Notification) error {
+	entry, err := t.cache.getEntry(e)
+	if err != nil {
+		return err
+	}
+
+	if entry == nil || entry.TicketID == -1 || entry.Resolved.IsZero() ||
+		(t.reopenWindow != 0 && time.Since(entry.Resolved) > t.reopenWindow) {
+		return t.create(e)
+	}
+
+	_, err = t.rtClient.UpdateTicket(&rt.Ticket{ID: entry.TicketID, Status: t.openStatus})
+	if err != nil {
+		return err
+	}
+
+	err = t.rtClient.CommentTicket(entry.TicketID, t.formatComment(e))
+	if err != nil {
+		return err
+	}
+
+	if *debug {
+		log.Printf("%x ticket updater: reopened ticket #%v", eventID(e), entry.TicketID)
+	}
+
+	return t.cache.updateEventTicket(e, entry.TicketID)
+}
+
+func (t *ticketUpdater) setStatus(e *event.Notification, status string) error {
+	return t.updateTicket(e, &rt.Ticket{Status: status})
+}
+
+func (t *ticketUpdater) setPriority(e *event.Notification, priority string) error {
+	return t.updateTicket(e, &rt.Ticket{Priority: priority})
+}
+
+func (t *ticketUpdater) assign(e *event.Notification, owner string) error {
+	return t.updateTicket(e, &rt.Ticket{Owner: owner})
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/bytemine/go-icinga2/event"
 	"github.com/bytemine/icinga2rt/rt"
@@ -139,90 +140,416 @@ func TestTicketUpdaterUpdate(t *testing.T) {
 		t.Error(err)
 	}
 
-	rt := NewDummyRT()
-	cache, cachePath, err := tempCache()
-	if err != nil {
-		t.Error(err)
-	}
-	defer removeCache(cache, cachePath)
+	testCaches(t, func(t *testing.T, cache *cache) {
+		rt := NewDummyRT()
 
-	tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+		tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
 
-	for _, v := range tests {
-		t.Logf("%+v", v)
-		if v.ExistsBefore {
-			x, ticketID, err := cache.getEventTicket(v.Event)
-			if err != nil {
-				t.Error(err)
-			}
+		for _, v := range tests {
+			t.Logf("%+v", v)
+			if v.ExistsBefore {
+				x, ticketID, err := cache.getEventTicket(v.Event)
+				if err != nil {
+					t.Error(err)
+				}
 
-			if x == nil {
-				t.Log("before: event in cache is nil")
-				t.Fail()
-			}
+				if x == nil {
+					t.Log("before: event in cache is nil")
+					t.Fail()
+				}
 
-			if ticketID == -1 {
-				t.Log("before: ticket id is nil")
-				t.Fail()
+				if ticketID == -1 {
+					t.Log("before: ticket id is nil")
+					t.Fail()
+				}
 			}
-		}
-
-		err := tu.update(v.Event)
-		if err != nil {
-			t.Error(err)
-		}
 
-		if v.ExistsAfter {
-			x, ticketID, err := cache.getEventTicket(v.Event)
+			err := tu.update(v.Event)
 			if err != nil {
 				t.Error(err)
 			}
 
-			if x == nil {
-				t.Log("after: event in cache is nil")
-				t.Fail()
-			}
+			if v.ExistsAfter {
+				x, ticketID, err := cache.getEventTicket(v.Event)
+				if err != nil {
+					t.Error(err)
+				}
 
-			if ticketID == -1 {
-				t.Log("after: ticket id is nil")
-				t.Fail()
-			}
+				if x == nil {
+					t.Log("after: event in cache is nil")
+					t.Fail()
+				}
 
-			if v.Event.CheckResult.State != x.CheckResult.State {
-				t.Logf("after: event state: %v expected: %v", x.CheckResult.State, v.Event.CheckResult.State)
-				t.Fail()
+				if ticketID == -1 {
+					t.Log("after: ticket id is nil")
+					t.Fail()
+				}
+
+				if v.Event.CheckResult.State != x.CheckResult.State {
+					t.Logf("after: event state: %v expected: %v", x.CheckResult.State, v.Event.CheckResult.State)
+					t.Fail()
+				}
 			}
 		}
-	}
+	})
 }
 
 // DummyClient is a mock RT client used for testing.
 type DummyRT struct {
-	tickets []rt.Ticket
+	tickets  []rt.Ticket
+	comments map[int][]string
+	// failUpdates makes UpdateTicket fail.
+	failUpdates bool
+	// failCreates makes NewTicket fail.
+	failCreates bool
 }
 
 func NewDummyRT() *DummyRT {
-	return &DummyRT{tickets: make([]rt.Ticket, 0)}
+	return &DummyRT{tickets: make([]rt.Ticket, 0), comments: make(map[int][]string)}
 }
 
 func (d *DummyRT) Ticket(id int) (*rt.Ticket, error) {
 	if len(d.tickets) > id {
 		return &d.tickets[id], nil
 	}
-	return nil, fmt.Errorf("no ticket")
+	return nil, rt.ErrNotFound
 }
 
 func (d *DummyRT) NewTicket(ticket *rt.Ticket) (*rt.Ticket, error) {
+	if d.failCreates {
+		return nil, fmt.Errorf("can't create ticket")
+	}
+
 	ticket.ID = len(d.tickets)
 	d.tickets = append(d.tickets, *ticket)
 	return ticket, nil
 }
 
+// UpdateTicket changes only the fields set in ticket, like an edit in RT.
 func (d *DummyRT) UpdateTicket(ticket *rt.Ticket) (*rt.Ticket, error) {
-	d.tickets[ticket.ID] = *ticket
-	return ticket, nil
+	if d.failUpdates || ticket.ID < 0 || ticket.ID >= len(d.tickets) {
+		return nil, fmt.Errorf("no ticket")
+	}
+
+	x := &d.tickets[ticket.ID]
+	if ticket.Queue != "" {
+		x.Queue = ticket.Queue
+	}
+	if ticket.Owner != "" {
+		x.Owner = ticket.Owner
+	}
+	if ticket.Status != "" {
+		x.Status = ticket.Status
+	}
+	if ticket.Priority != "" {
+		x.Priority = ticket.Priority
+	}
+	if ticket.AdminCc != "" {
+		x.AdminCc = ticket.AdminCc
+	}
+	if ticket.Starts != "" {
+		x.Starts = ticket.Starts
+	}
+	if ticket.Due != "" {
+		x.Due = ticket.Due
+	}
+
+	return x, nil
 }
 
 func (d *DummyRT) CommentTicket(id int, comment string) error {
+	d.comments[id] = append(d.comments[id], comment)
 	return nil
 }
+
+const testResolveMappingsCSV = `# state, old state, owned, action
+OK,CRITICAL,false,resolve
+OK,CRITICAL,true,comment
+CRITICAL,,false,reopen
+CRITICAL,CRITICAL,false,setpriority:90
+WARNING,CRITICAL,false,setstatus:stalled
+CRITICAL,WARNING,false,assign:JohnDoe
+`
+
+func TestTicketUpdaterResolveReopen(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testResolveMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCaches(t, func(t *testing.T, cache *cache) {
+		rt := NewDummyRT()
+
+		tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"resolved", "deleted"})
+		tu.reopenWindow = time.Hour
+
+		steps := []struct {
+			Event   *event.Notification
+			Tickets int    // number of tickets created after processing
+			Status  string // status of the first ticket after processing
+		}{
+			{Event: newTestEvent("example.com", "example", event.StateCritical), Tickets: 1, Status: ""},
+			{Event: newTestEvent("example.com", "example", event.StateCritical), Tickets: 1, Status: ""},
+			{Event: newTestEvent("example.com", "example", event.StateOK), Tickets: 1, Status: "resolved"},
+			{Event: newTestEvent("example.com", "example", event.StateCritical), Tickets: 1, Status: "open"},
+			{Event: newTestEvent("example.com", "example", event.StateWarning), Tickets: 1, Status: "stalled"},
+		}
+
+		for i, v := range steps {
+			if err := tu.update(v.Event); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rt.tickets) != v.Tickets {
+				t.Errorf("step %v: got %v tickets, expected %v", i, len(rt.tickets), v.Tickets)
+			}
+
+			if rt.tickets[0].Status != v.Status {
+				t.Errorf("step %v: got status %v, expected %v", i, rt.tickets[0].Status, v.Status)
+			}
+
+			if v.Status != "resolved" {
+				continue
+			}
+
+			// resolving keeps the rest of the entry.
+			entry, err := cache.getEntry(v.Event)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if entry.Resolved.IsZero() || entry.Created.IsZero() || len(entry.History) == 0 {
+				t.Errorf("step %v: entry wasn't kept: %+v", i, entry)
+			}
+		}
+
+		if rt.tickets[0].Priority != "90" {
+			t.Errorf("priority wasn't set: %+v", rt.tickets[0])
+		}
+
+		if len(rt.comments[0]) != 2 {
+			t.Errorf("expected comments for resolve and reopen, got: %v", rt.comments[0])
+		}
+
+		if err := tu.update(newTestEvent("example.com", "example", event.StateCritical)); err != nil {
+			t.Fatal(err)
+		}
+
+		if rt.tickets[0].Owner != "JohnDoe" {
+			t.Errorf("ticket wasn't assigned: %+v", rt.tickets[0])
+		}
+
+		// a problem long after resolving gets a new ticket.
+		tu.reopenWindow = time.Nanosecond
+		for _, v := range []*event.Notification{
+			newTestEvent("example.com", "other", event.StateCritical),
+			newTestEvent("example.com", "other", event.StateOK),
+			newTestEvent("example.com", "other", event.StateCritical),
+		} {
+			if err := tu.update(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(rt.tickets) != 3 || rt.tickets[1].Status != "resolved" {
+			t.Errorf("expected a new ticket after the reopen window, got: %+v", rt.tickets)
+		}
+	})
+}
+
+const testChainMappingsCSV = `# state, old state, owned, action
+CRITICAL,,false,create
+OK,CRITICAL,false,comment+setpriority:10+resolve
+`
+
+func TestTicketUpdaterActionChain(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testChainMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCaches(t, func(t *testing.T, cache *cache) {
+		rt := NewDummyRT()
+
+		tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"resolved"})
+
+		for _, v := range []string{"first", "second"} {
+			if err := tu.update(newTestEvent("example.com", v, event.StateCritical)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := tu.update(newTestEvent("example.com", "first", event.StateOK)); err != nil {
+			t.Fatal(err)
+		}
+
+		if rt.tickets[0].Status != "resolved" || rt.tickets[0].Priority != "10" || len(rt.comments[0]) != 2 {
+			t.Errorf("chain wasn't executed completely: %+v %v", rt.tickets[0], rt.comments[0])
+		}
+
+		// the comment succeeds, setting the priority fails.
+		rt.failUpdates = true
+		e := newTestEvent("example.com", "second", event.StateOK)
+
+		err = tu.update(e)
+		if err == nil || !strings.Contains(err.Error(), "step 2 of 3 (setpriority:10)") {
+			t.Errorf("expected error of second step, got: %v", err)
+		}
+
+		x, ticketID, err := cache.getEventTicket(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ticketID != 1 || x.CheckResult.State != event.StateCritical {
+			t.Errorf("cache entry wasn't restored: #%v %+v", ticketID, x)
+		}
+	})
+}
+
+func TestTicketUpdaterCommentWithoutTicket(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader("*,*,*,ACKNOWLEDGEMENT,*,*,*,comment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCaches(t, func(t *testing.T, cache *cache) {
+		rt := NewDummyRT()
+
+		tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"resolved"})
+
+		e := newTestEvent("example.com", "example", event.StateCritical)
+		e.NotificationType = "ACKNOWLEDGEMENT"
+
+		if err := tu.update(e); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rt.comments) != 0 {
+			t.Errorf("commented without ticket: %v", rt.comments)
+		}
+
+		if et, err := cache.getEntry(e); err != nil || et != nil {
+			t.Errorf("saved entry without ticket: %+v %v", et, err)
+		}
+	})
+}
+
+func TestTicketUpdaterHistory(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCaches(t, func(t *testing.T, cache *cache) {
+		rt := NewDummyRT()
+
+		tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+
+		e := newTestEvent("example.com", "example", event.StateWarning)
+		states := []event.State{event.StateWarning, event.StateCritical}
+		for i := 0; i < maxHistory; i++ {
+			e = newTestEvent("example.com", "example", states[i%2])
+			if err := tu.update(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		et, err := cache.getEntry(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(et.History) != maxHistory || et.History[0].Action != "create" || et.History[1].Action != "comment" {
+			t.Fatalf("unexpected history: %+v", et.History)
+		}
+
+		if et.History[maxHistory-1].State != "CRITICAL" {
+			t.Errorf("unexpected state: %+v", et.History[maxHistory-1])
+		}
+
+		// the oldest actions are dropped and the status of the ticket is recorded.
+		rt.tickets[0].Status = "open"
+		if err := tu.update(newTestEvent("example.com", "example", event.StateWarning)); err != nil {
+			t.Fatal(err)
+		}
+
+		et, err = cache.getEntry(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(et.History) != maxHistory || et.History[0].Action != "comment" {
+			t.Errorf("history wasn't trimmed: %+v", et.History)
+		}
+
+		if et.TicketStatus != "open" {
+			t.Errorf("ticket status wasn't recorded: %v", et.TicketStatus)
+		}
+	})
+}
+
+const testHostMappingsCSV = `# state, old state, owned, action
+DOWN,,false,create
+UNREACHABLE,,false,create
+DOWN,UNREACHABLE,false,comment
+UP,DOWN,false,delete
+UP,UNREACHABLE,false,delete
+UP,,false,ignore
+`
+
+func TestTicketUpdaterHost(t *testing.T) {
+	testMappings, err := readMappings(strings.NewReader(testHostMappingsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCaches(t, func(t *testing.T, cache *cache) {
+		rt := NewDummyRT()
+
+		tu := newTicketUpdater(cache, rt, testMappings, "", "Test-Queue", []string{"deleted"})
+
+		unreachable := newTestEvent("example.com", "", event.StateCritical)
+		unreachable.CheckResult.VarsAfter.Reachable = false
+
+		steps := []struct {
+			Event   *event.Notification
+			Tickets int    // number of tickets created after processing
+			Status  string // status of the last ticket after processing
+		}{
+			{Event: newTestEvent("example.com", "", event.StateOK), Tickets: 0},
+			{Event: unreachable, Tickets: 1, Status: ""},
+			{Event: newTestEvent("example.com", "", event.StateCritical), Tickets: 1, Status: ""},
+			{Event: newTestEvent("example.com", "", event.StateOK), Tickets: 1, Status: "deleted"},
+			{Event: newTestEvent("example.com", "", event.StateCritical), Tickets: 2, Status: ""},
+			{Event: newTestEvent("example.com", "", event.StateWarning), Tickets: 2, Status: "deleted"},
+		}
+
+		for i, v := range steps {
+			if err := tu.update(v.Event); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rt.tickets) != v.Tickets {
+				t.Fatalf("step %v: got %v tickets, expected %v", i, len(rt.tickets), v.Tickets)
+			}
+
+			if v.Tickets > 0 && rt.tickets[v.Tickets-1].Status != v.Status {
+				t.Errorf("step %v: got status %v, expected %v", i, rt.tickets[v.Tickets-1].Status, v.Status)
+			}
+		}
+
+		if rt.tickets[0].Subject != "Host: example.com is UNREACHABLE" || rt.tickets[1].Subject != "Host: example.com is DOWN" {
+			t.Errorf("unexpected subjects: %v, %v", rt.tickets[0].Subject, rt.tickets[1].Subject)
+		}
+
+		if len(rt.comments[0]) != 1 || rt.comments[0][0] != "DOWN" {
+			t.Errorf("unexpected comments: %v", rt.comments[0])
+		}
+
+		_, ticketID, err := cache.getEventTicket(unreachable)
+		if err != nil || ticketID != -1 {
+			t.Errorf("ticket wasn't removed from cache: #%v %v", ticketID, err)
+		}
+	})
+}
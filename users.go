@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/objects"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+// Ticket fields the email addresses of notified users can be added to.
+const (
+	usersFieldRequestors = "Requestors"
+	usersFieldCc         = "Cc"
+	usersFieldAdminCc    = "AdminCc"
+)
+
+// usersConfig maps the Icinga users notified by an event to properties of new tickets.
+type usersConfig struct {
+	// Field of new tickets the email addresses of notified users are added to, disabled if empty.
+	Field string
+	// Emails of Icinga users by name. Users not listed are looked up using the objects API if Lookup is set.
+	Emails map[string]string `json:",omitempty"`
+	Lookup bool
+	// Owners are Request Tracker users by Icinga user name. The first notified user listed becomes the owner.
+	Owners map[string]string `json:",omitempty"`
+}
+
+// checkUsers validates the field of the users config.
+func checkUsers(c usersConfig) error {
+	switch c.Field {
+	case "", usersFieldRequestors, usersFieldCc, usersFieldAdminCc:
+		return nil
+	default:
+		return fmt.Errorf("invalid field %v", c.Field)
+	}
+}
+
+// users maps notified users to email addresses and owners, remembering looked up and unknown users.
+type users struct {
+	usersConfig
+	objects objectsClient
+	// unknown users are only logged once.
+	unknown map[string]bool
+}
+
+func newUsers(c usersConfig, objects objectsClient) *users {
+	emails := make(map[string]string)
+	for k, v := range c.Emails {
+		emails[k] = v
+	}
+	c.Emails = emails
+
+	return &users{usersConfig: c, objects: objects, unknown: make(map[string]bool)}
+}
+
+// email returns the email address of the Icinga user, or the empty string if it isn't known.
+func (u *users) email(name string) string {
+	if email, ok := u.Emails[name]; ok {
+		return email
+	}
+
+	if u.unknown[name] {
+		return ""
+	}
+
+	if u.Lookup && u.objects != nil {
+		user, err := u.objects.User(name)
+		switch {
+		case err == nil && user.Email != "":
+			u.Emails[name] = user.Email
+			return user.Email
+		case err != nil && err != objects.ErrNotFound:
+			// don't remember users which couldn't be looked up, the API may be back next time.
+			log.Printf("ticket updater: couldn't look up user %v: %v", name, err)
+			return ""
+		}
+	}
+
+	log.Printf("ticket updater: no email address of user %v, skipping", name)
+	u.unknown[name] = true
+	return ""
+}
+
+// apply adds the email addresses of the users notified by the event to the ticket, and sets the owner if not set yet.
+func (u *users) apply(e *event.Notification, ticket *rt.Ticket) {
+	if ticket.Owner == "" {
+		for _, v := range e.Users {
+			if owner, ok := u.Owners[v]; ok {
+				ticket.Owner = owner
+				break
+			}
+		}
+	}
+
+	if u.Field == "" {
+		return
+	}
+
+	emails := []string{}
+	for _, v := range e.Users {
+		if email := u.email(v); email != "" {
+			emails = append(emails, email)
+		}
+	}
+
+	if len(emails) == 0 {
+		return
+	}
+
+	var field *string
+	switch u.Field {
+	case usersFieldRequestors:
+		field = &ticket.Requestors
+	case usersFieldCc:
+		field = &ticket.Cc
+	case usersFieldAdminCc:
+		field = &ticket.AdminCc
+	}
+
+	if *field != "" {
+		emails = append([]string{*field}, emails...)
+	}
+
+	*field = strings.Join(emails, ", ")
+}
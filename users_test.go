@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytemine/go-icinga2/event"
+	"github.com/bytemine/icinga2rt/rt"
+)
+
+func TestUsersApply(t *testing.T) {
+	u := newUsers(usersConfig{
+		Field:  usersFieldCc,
+		Emails: map[string]string{"ops": "ops@example.com"},
+		Lookup: true,
+		Owners: map[string]string{"oncall": "JaneDoe", "jdoe": "JohnDoe"},
+	}, testObjects)
+
+	e := &event.Notification{Host: "example.com", Users: []string{"ops", "unknown", "jdoe", "nomail", "oncall"}}
+
+	ticket := &rt.Ticket{Cc: "dba@example.com"}
+	u.apply(e, ticket)
+
+	if ticket.Cc != "dba@example.com, ops@example.com, jdoe@example.com" {
+		t.Errorf("unexpected Cc: %v", ticket.Cc)
+	}
+
+	if ticket.Owner != "JohnDoe" {
+		t.Errorf("unexpected owner: %v", ticket.Owner)
+	}
+
+	if !u.unknown["unknown"] || !u.unknown["nomail"] || u.Emails["jdoe"] != "jdoe@example.com" {
+		t.Errorf("users weren't remembered: %v %v", u.unknown, u.Emails)
+	}
+
+	// owners set by routing aren't changed.
+	ticket = &rt.Ticket{Owner: "dba"}
+	u.apply(e, ticket)
+
+	if ticket.Owner != "dba" || ticket.Cc != "ops@example.com, jdoe@example.com" {
+		t.Errorf("unexpected ticket: %+v", ticket)
+	}
+}
+
+func TestCheckUsers(t *testing.T) {
+	for _, v := range []string{"", "Requestors", "Cc", "AdminCc"} {
+		if err := checkUsers(usersConfig{Field: v}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := checkUsers(usersConfig{Field: "Bcc"}); err == nil {
+		t.Error("expected error for invalid field")
+	}
+}